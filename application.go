@@ -1,39 +1,178 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type TargetName string
 
 type Application interface {
-	BuildCmd() string
+	// The fields below take the target the deploy is for, and return the
+	// target's override of the application level value, if it has one.
+
+	BuildCmd(name TargetName) string
 
 	BuildOutputDir() string
 
-	PostDeployCmd() string
+	PostDeployCmd(vars RunVars) string
+
+	// RunCmd returns the command to run the app for vars.Target, an
+	// error if it has none
+	RunCmd(vars RunVars) (string, error)
+
+	// User declared substitution variables (see RunVars)
+	Vars() map[string]string
+
+	HealthCheck(name TargetName) *HealthCheck
+
+	// Environment variables to export to the app process, with any
+	// overrides for the given target applied
+	Env(name TargetName) map[string]string
+
+	// Additional processes started alongside RunCmd, sorted by name
+	Processes() []*AppProcess
+
+	// How the logs of the app's processes are rotated
+	LogPolicy() *LogPolicy
+
+	// How long the app's processes have to exit after SIGTERM when they're
+	// stopped, before they're killed
+	StopTimeout() time.Duration
 
-	RunCmd(port int) string
+	// Resource limits on the app's processes, nil if none
+	Limits() *Limits
 
-	HealthEndpoint() string
+	// Who the app's processes run as on the server, "" for the server's
+	// default
+	User() string
+	Group() string
 
-	// e.g. prod -> Target{...}
+	// Commands run on the server around changes to a deploy, nil if none
+	Hooks() *Hooks
+
+	// e.g. prod -> Target{...}. name may also be a group, or "tag:<tag>"
+	// for all targets with that tag.
 	Targets(name TargetName) []*Target
 }
 
+// Prefix of target names that select all targets with a tag, e.g. tag:sydney
+const tagPrefix = "tag:"
+
 type AppImpl struct {
-	def ApplicationDef
+	def         ApplicationDef
+	healthCheck *HealthCheck
+	processes   []*AppProcess
+	logPolicy   *LogPolicy
+	stopTimeout time.Duration
+	limits      *Limits
+	hooks       *Hooks
+
+	// targets that override the application's health check
+	targetHealthChecks map[TargetName]*HealthCheck
+}
+
+// An additional process type of an application, e.g. a queue worker
+type AppProcess struct {
+	Name    string
+	HasPort bool
+
+	// nil if the process has no health check, in which case it is
+	// considered healthy as long as it is running
+	HealthCheck *HealthCheck
+
+	runCmd string
+}
+
+// RunVars are the values substituted for %NAME% patterns in RunCmd,
+// PostDeployCmd and health checks. User declared Vars are substituted
+// first, so their values may refer to the built in ones.
+type RunVars struct {
+	// %PORT%, 0 if there isn't one, in which case %PORT% is left as is
+	Port int
+
+	// %DEPLOY_ID%
+	DeployId string
+
+	// %DEPLOY_DIR%
+	DeployDir string
+
+	// %TARGET%, the target the deploy was pushed to
+	Target TargetName
+
+	// %SERVER_ROOT%
+	ServerRoot string
+
+	// %FRONT_PORT%, the haproxy frontend port
+	FrontPort int
+
+	// From deploy.json's Vars, e.g. "CACHE": "/var/cache/myapp"
+	Vars map[string]string
+}
+
+var builtinVarNames = []string{
+	"PORT", "DEPLOY_ID", "DEPLOY_DIR", "TARGET", "SERVER_ROOT", "FRONT_PORT",
+}
+
+func (v RunVars) Expand(str string) string {
+	for name, value := range v.Vars {
+		str = strings.Replace(str, "%"+name+"%", value, -1)
+	}
+	if v.Port != 0 {
+		str = strings.Replace(str, "%PORT%", strconv.Itoa(v.Port), -1)
+	}
+	str = strings.Replace(str, "%DEPLOY_ID%", v.DeployId, -1)
+	str = strings.Replace(str, "%DEPLOY_DIR%", v.DeployDir, -1)
+	str = strings.Replace(str, "%TARGET%", string(v.Target), -1)
+	str = strings.Replace(str, "%SERVER_ROOT%", v.ServerRoot, -1)
+	str = strings.Replace(str, "%FRONT_PORT%", strconv.Itoa(v.FrontPort), -1)
+	return str
+}
+
+type ProcessDef struct {
+	RunCmd string
+
+	// If true, camus gives the process its own port, substituted
+	// for %PORT% in RunCmd
+	Port bool
+
+	// optional. Processes with a port default to a tcp check, and ones
+	// without can only use exec checks.
+	HealthCheck *HealthCheckDef
 }
 
 type Target struct {
+	// Filled in from the key in 'Targets'
+	Name TargetName `json:"-"`
+
 	Ssh string // e.g. user@host
 
 	SshPort int // optional
 
 	Base int // camus base port, e.g. 8000
+
+	// optional, e.g. ["sydney", "web"]. Select all targets with a tag
+	// using "tag:<tag>" as the target name
+	Tags []string
+
+	// optional, overrides entries in the application level Env
+	Env map[string]string
+
+	// optional overrides of the application level settings,
+	// for deploys to this target
+	BuildCmd       string
+	PostDeployCmd  string
+	RunCmd         string
+	HealthEndpoint string
+	HealthCheck    *HealthCheckDef
 }
 
 type ApplicationDef struct {
@@ -45,120 +184,676 @@ type ApplicationDef struct {
 
 	PostDeployCmd string
 
-	// needs a %PORT% part for port subsitution
+	// needs a %PORT% part for port subsitution. See RunVars for the
+	// other variables that are substituted.
 	RunCmd string
 
+	// optional, user declared variables substituted as %NAME% in RunCmd,
+	// PostDeployCmd and health checks
+	Vars map[string]string
+
+	// Deprecated, equivalent to a HealthCheck with only Path set
 	HealthEndpoint string
 
+	// optional, how to decide whether the app is healthy
+	HealthCheck *HealthCheckDef
+
+	// optional, additional processes to run as part of each deploy,
+	// keyed by a name, e.g. "worker"
+	Processes map[string]*ProcessDef
+
+	// Environment variables exported to the app process when it is run.
+	// Targets may override individual entries.
+	Env map[string]string
+
+	// optional, limits on the size and age of the logs of the app's
+	// processes on the server
+	Logs *LogsDef
+
+	// optional, how long the app's processes have to exit after SIGTERM
+	// when stopped before they're killed, e.g. "30s" (default 10s)
+	StopTimeout string
+
+	// optional, resource limits on the app's processes on the server
+	Limits *LimitsDef
+
+	// optional, the user (name or uid) the app's processes run as on the
+	// server, and the group (name or gid, defaults to the user's). Only
+	// for servers that don't set their own User, and not root unless the
+	// server allows it.
+	User  string
+	Group string
+
+	// optional, commands run on the server around running, setting and
+	// stopping the app's deploys
+	Hooks *HooksDef
+
 	// e.g. user@host  (no path)
 	Targets map[TargetName]*Target
 
 	// Maps a name to a list of targets. Camus will then perform all
-	// specified actions on all targets
+	// specified actions on all targets. Entries may also be other groups,
+	// or "tag:<tag>" for all targets with that tag.
 	GroupTargets map[TargetName][]TargetName
 }
 
-func ApplicationFromConfig(isClient bool, file string) (Application, error) {
-	var def ApplicationDef
+// ConfigErrors lists every problem found in a deploy.json
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	if len(e) == 1 {
+		return "deploy.json: " + e[0]
+	}
+	return fmt.Sprintf("deploy.json: %d problems\n  %s", len(e), strings.Join(e, "\n  "))
+}
 
-	data, err := ioutil.ReadFile(file)
+// ApplicationFromConfig loads a deploy.json, merged with its overlays for
+// the given target (see config_layers.go).
+func ApplicationFromConfig(isClient bool, file string, target TargetName) (Application, error) {
+	data, _, err := loadConfigLayers(file, target, false)
 	if err != nil {
 		return nil, err
 	}
 
-	errMsg := func(str string, args ...interface{}) (Application, error) {
-		return nil, fmt.Errorf("deploy.json: "+str, args...)
+	return applicationFromData(isClient, data)
+}
+
+// applicationFromData parses and validates a deploy.json. All problems
+// found are reported together, as ConfigErrors.
+func applicationFromData(isClient bool, data []byte) (Application, error) {
+	var def ApplicationDef
+
+	if err := unmarshalConfig(data, &def); err != nil {
+		return nil, ConfigErrors{fmt.Sprintf("Invalid json, %s", err)}
+	}
+
+	errs := ConfigErrors{}
+	errMsg := func(str string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(str, args...))
 	}
 
-	if err := json.Unmarshal(data, &def); err != nil {
-		return errMsg(fmt.Sprintf("Invalid json %s", err))
+	for _, key := range findDuplicateKeys(data) {
+		errMsg("Duplicate key %s", key)
+	}
+
+	targetNames := []TargetName{}
+	for _, name := range def.targetNames() {
+		if def.Targets[name] == nil {
+			errMsg("%s should be an object", name)
+			continue
+		}
+		def.Targets[name].Name = name
+		targetNames = append(targetNames, name)
+
+		if strings.HasPrefix(string(name), tagPrefix) {
+			errMsg("Target name %s can't start with '%s'", name, tagPrefix)
+		}
+		for _, tag := range def.Targets[name].Tags {
+			if len(tag) == 0 || strings.ContainsAny(tag, " ,") {
+				errMsg("Invalid tag '%s' in %s.Tags", tag, name)
+			}
+		}
+	}
+
+	if err := checkEnv("Env", def.Env); err != nil {
+		errMsg("%s", err)
+	}
+	for name := range def.Vars {
+		if !varNamePattern.MatchString(name) {
+			errMsg("Invalid Vars name '%s' (use A-Z, 0-9 and _)", name)
+		}
+		for _, builtin := range builtinVarNames {
+			if name == builtin {
+				errMsg("Vars can't redefine the built in variable %s", name)
+			}
+		}
+	}
+	for _, name := range targetNames {
+		if err := checkEnv(fmt.Sprintf("%s.Env", name), def.Targets[name].Env); err != nil {
+			errMsg("%s", err)
+		}
 	}
 
 	if isClient {
 		if len(def.Name) == 0 {
-			return errMsg("Missing Name")
+			errMsg("Missing Name")
 		}
-		if len(def.BuildCmd) == 0 {
-			return errMsg("Missing BuildCmd")
+		if len(def.BuildCmd) == 0 &&
+			!def.everyTargetOverrides(func(t *Target) bool { return len(t.BuildCmd) > 0 }) {
+			errMsg("Missing BuildCmd")
 		}
 		if len(def.BuildOutputDir) == 0 {
-			return errMsg("Missing BuildOutputDir")
+			errMsg("Missing BuildOutputDir")
 		}
 
-		foundTarget := false
-		for name, target := range def.Targets {
-			foundTarget = true
+		for _, name := range targetNames {
+			target := def.Targets[name]
 			if len(target.Ssh) == 0 {
-				return errMsg("Missing %s.Ssh", name)
+				errMsg("Missing %s.Ssh", name)
 			}
 			if target.Base == 0 {
-				return errMsg("Missing %s.Base", name)
+				errMsg("Missing %s.Base", name)
+			} else if target.Base < 1 || target.Base+99 > 65535 {
+				errMsg("%s.Base %d is out of range (the server uses ports %s.Base "+
+					"to %s.Base+99)", name, target.Base, name, name)
 			}
 			if target.SshPort == 0 {
 				target.SshPort = 22
+			} else if target.SshPort < 1 || target.SshPort > 65535 {
+				errMsg("%s.SshPort %d is out of range", name, target.SshPort)
 			}
 		}
 
-		if !foundTarget {
-			return errMsg("No 'Targets' entry defined (need at least one)")
+		if len(def.Targets) == 0 {
+			errMsg("No 'Targets' entry defined (need at least one)")
 		}
 
-		for name, group := range def.GroupTargets {
+		reportedCycles := map[string]bool{}
+		for _, name := range def.groupNames() {
 			if _, ok := def.Targets[name]; ok {
-				return errMsg("%s appears as a target name in both 'GroupTargets and "+
+				errMsg("%s appears as a target name in both 'GroupTargets and "+
 					"'Targets' (keys must be unique across both maps)", name)
 			}
+			if strings.HasPrefix(string(name), tagPrefix) {
+				errMsg("Group name %s can't start with '%s'", name, tagPrefix)
+			}
 
-			for _, name := range group {
-				if _, ok := def.Targets[name]; !ok {
-					return errMsg("Expected %s to appear as an entry in 'Targets'.", name)
+			seen := map[TargetName]bool{}
+			for _, member := range def.GroupTargets[name] {
+				_, isTarget := def.Targets[member]
+				_, isGroup := def.GroupTargets[member]
+				if strings.HasPrefix(string(member), tagPrefix) {
+					if len(def.taggedTargets(member)) == 0 {
+						errMsg("No targets match %s (in group %s)", member, name)
+					}
+				} else if !isTarget && !isGroup {
+					errMsg("Expected %s (in group %s) to appear as an entry in 'Targets' "+
+						"or 'GroupTargets'.", member, name)
+				}
+				if seen[member] {
+					errMsg("%s appears more than once in group %s", member, name)
+				}
+				seen[member] = true
+			}
+
+			if cycle := def.findGroupCycle(name, nil); cycle != nil {
+				members := make([]string, len(cycle)-1)
+				for i, n := range cycle[1:] {
+					members[i] = string(n)
+				}
+				sort.Strings(members)
+				key := strings.Join(members, ",")
+				if !reportedCycles[key] {
+					reportedCycles[key] = true
+					errMsg("Groups refer to each other in a cycle: %s", joinTargetNames(cycle, " -> "))
 				}
 			}
 		}
 	}
 
+	runCmdOverridden := def.everyTargetOverrides(func(t *Target) bool {
+		return len(t.RunCmd) > 0
+	})
+	if len(def.RunCmd) == 0 && !runCmdOverridden {
+		errMsg("Missing RunCmd")
+	} else if len(def.RunCmd) > 0 && !usesPort(def.RunCmd) {
+		errMsg("RunCmd should contain %%PORT%% (or $PORT), so the app runs on " +
+			"the port camus gives it")
+	}
+
+	healthOverridden := def.everyTargetOverrides(func(t *Target) bool {
+		return t.HealthCheck != nil || len(t.HealthEndpoint) > 0
+	})
+	if def.HealthCheck == nil {
+		if len(def.HealthEndpoint) == 0 && isClient && !healthOverridden {
+			errMsg("Missing HealthCheck (or HealthEndpoint)")
+		}
+		def.HealthCheck = &HealthCheckDef{Path: def.HealthEndpoint}
+	} else if len(def.HealthEndpoint) != 0 {
+		errMsg("Only one of HealthCheck and HealthEndpoint may be given")
+	}
+
+	healthCheck, err := NewHealthCheck(*def.HealthCheck)
+	if err != nil {
+		errMsg("%s", err)
+	}
+
+	targetHealthChecks := map[TargetName]*HealthCheck{}
+	for _, name := range targetNames {
+		target := def.Targets[name]
+		if len(target.RunCmd) > 0 && !usesPort(target.RunCmd) {
+			errMsg("%s.RunCmd should contain %%PORT%% (or $PORT)", name)
+		}
+
+		if target.HealthCheck == nil && len(target.HealthEndpoint) == 0 {
+			continue
+		}
+		if target.HealthCheck != nil && len(target.HealthEndpoint) != 0 {
+			errMsg("Only one of %s.HealthCheck and %s.HealthEndpoint may be given", name, name)
+			continue
+		}
+		healthDef := target.HealthCheck
+		if healthDef == nil {
+			healthDef = &HealthCheckDef{Path: target.HealthEndpoint}
+		}
+		hc, err := NewHealthCheck(*healthDef)
+		if err != nil {
+			errMsg("%s.%s", name, err)
+			continue
+		}
+		targetHealthChecks[name] = hc
+	}
+
+	processes := []*AppProcess{}
+	for _, name := range def.processNames() {
+		proc, err := newAppProcess(name, def.Processes[name])
+		if err != nil {
+			errMsg("Processes.%s: %s", name, err)
+			continue
+		}
+		processes = append(processes, proc)
+	}
+
+	logPolicy, err := NewLogPolicy(def.Logs)
+	if err != nil {
+		errMsg("%s", err)
+	}
+
+	stopTimeout := defaultStopTimeout
+	if len(def.StopTimeout) > 0 {
+		stopTimeout, err = time.ParseDuration(def.StopTimeout)
+		if err != nil {
+			errMsg("Invalid StopTimeout: %s", err)
+		} else if stopTimeout <= 0 {
+			errMsg("StopTimeout should be positive")
+		}
+	}
+
+	limits, err := NewLimits(def.Limits)
+	if err != nil {
+		errMsg("%s", err)
+	}
+
+	if def.Group != "" && def.User == "" {
+		errMsg("Group needs a User")
+	}
+
+	hooks, err := NewHooks(def.Hooks)
+	if err != nil {
+		errMsg("%s", err)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return &AppImpl{def, healthCheck, processes, logPolicy, stopTimeout,
+		limits, hooks, targetHealthChecks}, nil
+}
+
+var varNamePattern = regexp.MustCompile("^[A-Z][A-Z0-9_]*$")
+
+func usesPort(cmd string) bool {
+	return strings.Contains(cmd, "%PORT%") ||
+		strings.Contains(cmd, "$PORT") ||
+		strings.Contains(cmd, "${PORT}")
+}
+
+func newAppProcess(name string, def *ProcessDef) (*AppProcess, error) {
+	if def == nil {
+		return nil, fmt.Errorf("should be an object")
+	}
+	if strings.ContainsAny(name, "/ ") {
+		return nil, fmt.Errorf("name should not contain '/' or spaces")
+	}
 	if len(def.RunCmd) == 0 {
-		return errMsg("Missing RunCmd")
+		return nil, fmt.Errorf("Missing RunCmd")
+	}
+	if def.Port && !usesPort(def.RunCmd) {
+		return nil, fmt.Errorf("RunCmd should contain %%PORT%% (or $PORT)")
+	}
+	if !def.Port && strings.Contains(def.RunCmd, "%PORT%") {
+		return nil, fmt.Errorf("RunCmd contains %%PORT%%, but Port is not set")
+	}
+
+	proc := &AppProcess{
+		Name:    name,
+		HasPort: def.Port,
+		runCmd:  def.RunCmd,
 	}
 
-	if len(def.HealthEndpoint) == 0 {
-		if isClient {
-			return errMsg("Missing HealthEndpoint")
-		} else {
-			def.HealthEndpoint = "/"
+	healthDef := def.HealthCheck
+	if healthDef == nil && def.Port {
+		healthDef = &HealthCheckDef{Type: tcpHealthCheck}
+	}
+	if healthDef != nil {
+		hc, err := NewHealthCheck(*healthDef)
+		if err != nil {
+			return nil, err
+		}
+		if !def.Port && hc.Type != execHealthCheck {
+			return nil, fmt.Errorf("only %s health checks can be used without a Port",
+				execHealthCheck)
 		}
+		proc.HealthCheck = hc
 	}
 
-	return &AppImpl{def}, nil
+	return proc, nil
 }
 
-func (a *AppImpl) RunCmd(port int) string {
-	return strings.Replace(a.def.RunCmd, "%PORT%", fmt.Sprintf("%d", port), -1)
+// RunCmd returns the command to run the process, with vars substituted
+func (p *AppProcess) RunCmd(vars RunVars) string {
+	return vars.Expand(p.runCmd)
 }
-func (a *AppImpl) Targets(name TargetName) (targets []*Target) {
-	if t, ok := a.def.Targets[name]; ok {
-		return []*Target{t}
+
+// validateDeployFile checks a deploy.json (with its overlays for target) as
+// both the client and the server would load it, and returns every problem
+// found.
+func validateDeployFile(file string, target TargetName, isLocalTest bool) ([]string, error) {
+	data, _, err := loadConfigLayers(file, target, isLocalTest)
+	if errs, ok := err.(ConfigErrors); ok {
+		return errs, nil
+	} else if err != nil {
+		return nil, err
 	}
 
-	ts := []*Target{}
-	if targetNames, ok := a.def.GroupTargets[name]; ok {
-		for _, targetName := range targetNames {
-			ts = append(ts, a.def.Targets[targetName])
+	problems := []string{}
+	seen := map[string]bool{}
+	for _, isClient := range []bool{true, false} {
+		_, err := applicationFromData(isClient, data)
+		if errs, ok := err.(ConfigErrors); ok {
+			for _, problem := range errs {
+				if !seen[problem] {
+					seen[problem] = true
+					problems = append(problems, problem)
+				}
+			}
+		}
+	}
+
+	var def ApplicationDef
+	if err := unmarshalConfig(data, &def); err == nil && len(def.BuildOutputDir) > 0 {
+		if problem := checkBuildOutputDir(path.Dir(file), def.BuildOutputDir); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems, nil
+}
+
+// checkBuildOutputDir checks the build output dir either exists, or could be
+// created by the build (which runs in appDir).
+func checkBuildOutputDir(appDir string, dir string) string {
+	if !path.IsAbs(dir) {
+		dir = path.Join(appDir, dir)
+	}
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Sprintf("BuildOutputDir %s is not a directory", dir)
+		}
+		return ""
+	}
+	if _, err := os.Stat(path.Dir(dir)); err != nil {
+		return fmt.Sprintf("BuildOutputDir %s is unreachable (%s)", dir, err)
+	}
+	return ""
+}
+
+func (def *ApplicationDef) targetNames() []TargetName {
+	names := []TargetName{}
+	for name := range def.Targets {
+		names = append(names, name)
+	}
+	sortTargetNames(names)
+	return names
+}
+
+func (def *ApplicationDef) groupNames() []TargetName {
+	names := []TargetName{}
+	for name := range def.GroupTargets {
+		names = append(names, name)
+	}
+	sortTargetNames(names)
+	return names
+}
+
+// findGroupCycle returns the path of a cycle of groups reachable from the
+// given group, or nil if there isn't one.
+func (def *ApplicationDef) findGroupCycle(name TargetName, path []TargetName) []TargetName {
+	for i, n := range path {
+		if n == name {
+			return append(append([]TargetName{}, path[i:]...), name)
+		}
+	}
+	path = append(path, name)
+	for _, member := range def.GroupTargets[name] {
+		if _, isGroup := def.GroupTargets[member]; !isGroup {
+			continue
+		}
+		if cycle := def.findGroupCycle(member, path); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// taggedTargets returns the names of the targets with the tag in a
+// "tag:<tag>" name, sorted.
+func (def *ApplicationDef) taggedTargets(name TargetName) []TargetName {
+	tag := strings.TrimPrefix(string(name), tagPrefix)
+	names := []TargetName{}
+	for _, targetName := range def.targetNames() {
+		if target := def.Targets[targetName]; target != nil && contains(target.Tags, tag) {
+			names = append(names, targetName)
+		}
+	}
+	return names
+}
+
+// resolveTargets expands a target, group or tag name into the names of the
+// targets it refers to, appending any not already seen to names.
+func (def *ApplicationDef) resolveTargets(
+	name TargetName,
+	seen map[TargetName]bool,
+	names []TargetName) []TargetName {
+
+	if seen[name] {
+		return names
+	}
+	seen[name] = true
+
+	if strings.HasPrefix(string(name), tagPrefix) {
+		for _, targetName := range def.taggedTargets(name) {
+			names = def.resolveTargets(targetName, seen, names)
+		}
+	} else if _, ok := def.Targets[name]; ok {
+		names = append(names, name)
+	} else {
+		for _, member := range def.GroupTargets[name] {
+			names = def.resolveTargets(member, seen, names)
 		}
 	}
+	return names
+}
+
+func joinTargetNames(names []TargetName, sep string) string {
+	strs := make([]string, len(names))
+	for i, name := range names {
+		strs[i] = string(name)
+	}
+	return strings.Join(strs, sep)
+}
+
+// everyTargetOverrides is true if there is at least one target, and all of
+// them override some application level setting.
+func (def *ApplicationDef) everyTargetOverrides(overrides func(t *Target) bool) bool {
+	if len(def.Targets) == 0 {
+		return false
+	}
+	for _, target := range def.Targets {
+		if target == nil || !overrides(target) {
+			return false
+		}
+	}
+	return true
+}
+
+func (def *ApplicationDef) processNames() []string {
+	names := []string{}
+	for name := range def.Processes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortTargetNames(names []TargetName) {
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+}
+
+// findDuplicateKeys returns the path of every object key that appears more
+// than once in the same object, which json.Unmarshal silently allows.
+func findDuplicateKeys(data []byte) []string {
+	data, err := stripJsonComments(data)
+	if err != nil {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dups := []string{}
+
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			seen := map[string]bool{}
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key, _ := keyTok.(string)
+				keyPath := key
+				if path != "" {
+					keyPath = path + "." + key
+				}
+				if seen[key] {
+					dups = append(dups, keyPath)
+				}
+				seen[key] = true
+				if err := walk(keyPath); err != nil {
+					return err
+				}
+			}
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+		// closing delimiter
+		_, err = dec.Token()
+		return err
+	}
+
+	walk("")
+	return dups
+}
+
+func checkEnv(field string, env map[string]string) error {
+	for key := range env {
+		if len(key) == 0 || strings.ContainsAny(key, "= ") {
+			return fmt.Errorf("Invalid key '%s' in %s", key, field)
+		}
+	}
+	return nil
+}
+
+// override returns the target's value of a setting if it has one, or
+// otherwise the application level value.
+func (a *AppImpl) override(name TargetName, value string, targetValue func(t *Target) string) string {
+	if t, ok := a.def.Targets[name]; ok && t != nil && len(targetValue(t)) > 0 {
+		return targetValue(t)
+	}
+	return value
+}
+
+func (a *AppImpl) RunCmd(vars RunVars) (string, error) {
+	cmd := a.override(vars.Target, a.def.RunCmd,
+		func(t *Target) string { return t.RunCmd })
+	if cmd == "" {
+		// every target overrides RunCmd, and the deploy's target isn't
+		// one of them, e.g. it was pushed before targets were recorded
+		return "", fmt.Errorf("No RunCmd for target '%s'", vars.Target)
+	}
+	return vars.Expand(cmd), nil
+}
+func (a *AppImpl) Targets(name TargetName) (targets []*Target) {
+	ts := []*Target{}
+	for _, targetName := range a.def.resolveTargets(name, map[TargetName]bool{}, nil) {
+		ts = append(ts, a.def.Targets[targetName])
+	}
 
 	return ts
 }
 
-func (a *AppImpl) BuildCmd() string {
-	return a.def.BuildCmd
+func (a *AppImpl) BuildCmd(name TargetName) string {
+	return a.override(name, a.def.BuildCmd,
+		func(t *Target) string { return t.BuildCmd })
 }
-func (a *AppImpl) PostDeployCmd() string {
-	return a.def.PostDeployCmd
+func (a *AppImpl) PostDeployCmd(vars RunVars) string {
+	return vars.Expand(a.override(vars.Target, a.def.PostDeployCmd,
+		func(t *Target) string { return t.PostDeployCmd }))
+}
+func (a *AppImpl) Vars() map[string]string {
+	return a.def.Vars
 }
 func (a *AppImpl) BuildOutputDir() string {
 	return a.def.BuildOutputDir
 }
-func (a *AppImpl) HealthEndpoint() string {
-	return a.def.HealthEndpoint
+func (a *AppImpl) HealthCheck(name TargetName) *HealthCheck {
+	if hc, ok := a.targetHealthChecks[name]; ok {
+		return hc
+	}
+	return a.healthCheck
+}
+func (a *AppImpl) Processes() []*AppProcess {
+	return a.processes
+}
+func (a *AppImpl) LogPolicy() *LogPolicy {
+	return a.logPolicy
+}
+func (a *AppImpl) StopTimeout() time.Duration {
+	return a.stopTimeout
+}
+func (a *AppImpl) Limits() *Limits {
+	return a.limits
+}
+func (a *AppImpl) Hooks() *Hooks {
+	return a.hooks
+}
+func (a *AppImpl) User() string {
+	return a.def.User
+}
+func (a *AppImpl) Group() string {
+	return a.def.Group
+}
+func (a *AppImpl) Env(name TargetName) map[string]string {
+	env := map[string]string{}
+	for key, value := range a.def.Env {
+		env[key] = value
+	}
+	if t, ok := a.def.Targets[name]; ok {
+		for key, value := range t.Env {
+			env[key] = value
+		}
+	}
+	return env
 }
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeTempDeployFile(t *testing.T, data string) string {
+	f, err := ioutil.TempFile("", "camus-deploy-")
+	if err != nil {
+		t.Fatalf("create temp file: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatalf("write temp file: %s", err)
+	}
+	return f.Name()
+}
+
+func TestEnvTargetOverrides(t *testing.T) {
+	file := writeTempDeployFile(t, `{
+  "RunCmd": "node app.js %PORT%",
+  "Env": {"A": "1", "B": "2"},
+  "Targets": {
+    "prod": {"Ssh": "localhost", "Base": 8000, "Env": {"B": "3", "C": "4"}},
+    "staging": {"Ssh": "localhost", "Base": 7000}
+  }
+}`)
+	defer os.Remove(file)
+
+	app, err := ApplicationFromConfig(false, file, "")
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+
+	tests := []struct {
+		target   TargetName
+		expected map[string]string
+	}{
+		{"prod", map[string]string{"A": "1", "B": "3", "C": "4"}},
+		{"staging", map[string]string{"A": "1", "B": "2"}},
+		{"", map[string]string{"A": "1", "B": "2"}},
+	}
+	for _, test := range tests {
+		env := app.Env(test.target)
+		if len(env) != len(test.expected) {
+			t.Errorf("%s: expected env %v, got %v", test.target, test.expected, env)
+			continue
+		}
+		for key, value := range test.expected {
+			if env[key] != value {
+				t.Errorf("%s: expected %s=%s, got %s", test.target, key, value, env[key])
+			}
+		}
+	}
+}
+
+func TestEnvInvalidKey(t *testing.T) {
+	file := writeTempDeployFile(t, `{
+  "RunCmd": "node app.js %PORT%",
+  "Env": {"A=B": "1"}
+}`)
+	defer os.Remove(file)
+
+	if _, err := ApplicationFromConfig(false, file, ""); err == nil {
+		t.Fatalf("expected error for env key containing '='")
+	}
+}
+
+func TestConfigReportsAllProblems(t *testing.T) {
+	_, err := applicationFromData(true, []byte(`{
+  "Name": "MyApp",
+  "RunCmd": "node app.js",
+  "HealthEndpoint": "/status",
+  "Targets": {
+    "prod": {"Ssh": "localhost", "Base": 8000},
+    "prod": {"Ssh": "localhost", "Base": 70000}
+  },
+  "GroupTargets": {"all": ["prod", "staging"]},
+  "StopTimeout": "-1s"
+}`))
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+
+	expected := []string{
+		"Duplicate key Targets.prod",
+		"Missing BuildCmd",
+		"Missing BuildOutputDir",
+		"prod.Base 70000 is out of range",
+		"Expected staging (in group all)",
+		"RunCmd should contain %PORT%",
+		"StopTimeout should be positive",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d problems, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(errs[i], prefix) {
+			t.Errorf("expected problem %d to start with '%s', got '%s'", i, prefix, errs[i])
+		}
+	}
+}
+
+func TestProcesses(t *testing.T) {
+	app, err := applicationFromData(false, []byte(`{
+  "RunCmd": "node app.js %PORT%",
+  "Processes": {
+    "worker": {"RunCmd": "node worker.js"},
+    "admin": {"RunCmd": "node admin.js %PORT%", "Port": true}
+  }
+}`))
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+
+	procs := app.Processes()
+	if len(procs) != 2 || procs[0].Name != "admin" || procs[1].Name != "worker" {
+		t.Fatalf("expected admin and worker processes, got %v", procs)
+	}
+	if !procs[0].HasPort || procs[0].HealthCheck == nil || procs[0].HealthCheck.Type != "tcp" {
+		t.Errorf("expected admin to have a port and default tcp health check")
+	}
+	if cmd := procs[0].RunCmd(RunVars{Port: 8005}); cmd != "node admin.js 8005" {
+		t.Errorf("unexpected admin RunCmd %s", cmd)
+	}
+	if procs[1].HasPort || procs[1].HealthCheck != nil {
+		t.Errorf("expected worker to have no port or health check")
+	}
+
+	invalid := []string{
+		`{"worker": {"RunCmd": ""}}`,
+		`{"worker": {"RunCmd": "node worker.js %PORT%"}}`,
+		`{"worker": {"RunCmd": "node worker.js", "Port": true}}`,
+		`{"worker": {"RunCmd": "node worker.js", "HealthCheck": {"Path": "/status"}}}`,
+	}
+	for _, processes := range invalid {
+		_, err := applicationFromData(false, []byte(
+			`{"RunCmd": "node app.js %PORT%", "Processes": `+processes+`}`))
+		if err == nil {
+			t.Errorf("expected error for processes %s", processes)
+		}
+	}
+}
+
+func TestRunVarsExpand(t *testing.T) {
+	vars := RunVars{
+		Port:       8001,
+		DeployId:   "happy-paris-2016-01-01-00-00-00",
+		DeployDir:  "/srv/deploys/happy-paris-2016-01-01-00-00-00",
+		Target:     "prod",
+		ServerRoot: "/srv",
+		FrontPort:  8098,
+		Vars:       map[string]string{"CACHE": "%SERVER_ROOT%/cache/%DEPLOY_ID%"},
+	}
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"node app.js %PORT%", "node app.js 8001"},
+		{"run --id %DEPLOY_ID% --target %TARGET%",
+			"run --id happy-paris-2016-01-01-00-00-00 --target prod"},
+		{"%DEPLOY_DIR% %FRONT_PORT%", "/srv/deploys/happy-paris-2016-01-01-00-00-00 8098"},
+		{"--cache %CACHE%", "--cache /srv/cache/happy-paris-2016-01-01-00-00-00"},
+		{"date +%Y-%m %UNKNOWN%", "date +%Y-%m %UNKNOWN%"},
+	}
+	for _, test := range tests {
+		if result := vars.Expand(test.input); result != test.expected {
+			t.Errorf("expected '%s' to expand to '%s', got '%s'", test.input, test.expected, result)
+		}
+	}
+
+	if result := (RunVars{}).Expand("echo %PORT%"); result != "echo %PORT%" {
+		t.Errorf("%%PORT%% should be left alone without a port, got '%s'", result)
+	}
+}
+
+func TestInvalidVars(t *testing.T) {
+	for _, vars := range []string{`{"PORT": "1"}`, `{"lower": "1"}`} {
+		_, err := applicationFromData(false, []byte(
+			`{"RunCmd": "node app.js %PORT%", "Vars": `+vars+`}`))
+		if err == nil {
+			t.Errorf("expected error for Vars %s", vars)
+		}
+	}
+}
+
+func TestTargetOverrides(t *testing.T) {
+	app, err := applicationFromData(true, []byte(`{
+  "Name": "MyApp",
+  "BuildCmd": "./build.sh",
+  "BuildOutputDir": "./build",
+  "PostDeployCmd": "./migrate.sh",
+  "RunCmd": "node app.js %PORT%",
+  "HealthEndpoint": "/status",
+  "Targets": {
+    "prod": {"Ssh": "localhost", "Base": 8000},
+    "staging": {
+      "Ssh": "localhost", "Base": 7000,
+      "BuildCmd": "./build.sh --debug",
+      "PostDeployCmd": "./migrate.sh && ./seed.sh",
+      "RunCmd": "node app.js %PORT% --debug",
+      "HealthCheck": {"Path": "/debug/status"}
+    }
+  }
+}`))
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+
+	prod := RunVars{Port: 8001, Target: "prod"}
+	staging := RunVars{Port: 7001, Target: "staging"}
+	runCmd := func(vars RunVars) string {
+		cmd, err := app.RunCmd(vars)
+		if err != nil {
+			t.Errorf("%s: %s", vars.Target, err)
+		}
+		return cmd
+	}
+	tests := []struct {
+		actual   string
+		expected string
+	}{
+		{app.BuildCmd("prod"), "./build.sh"},
+		{app.BuildCmd("staging"), "./build.sh --debug"},
+		{app.PostDeployCmd(prod), "./migrate.sh"},
+		{app.PostDeployCmd(staging), "./migrate.sh && ./seed.sh"},
+		{runCmd(prod), "node app.js 8001"},
+		{runCmd(staging), "node app.js 7001 --debug"},
+		{app.HealthCheck("prod").Path, "/status"},
+		{app.HealthCheck("staging").Path, "/debug/status"},
+		{app.HealthCheck("").Path, "/status"},
+	}
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("expected '%s', got '%s'", test.expected, test.actual)
+		}
+	}
+}
+
+func TestTargetOverridesEveryRunCmd(t *testing.T) {
+	app, err := applicationFromData(false, []byte(`{
+  "HealthEndpoint": "/status",
+  "Targets": {
+    "prod": {"Ssh": "localhost", "Base": 8000, "RunCmd": "node app.js %PORT%"}
+  }
+}`))
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+	if cmd, err := app.RunCmd(RunVars{Port: 8001, Target: "prod"}); err != nil || cmd != "node app.js 8001" {
+		t.Errorf("expected prod's RunCmd, got %q, %v", cmd, err)
+	}
+	// e.g. a deploy pushed before its target was recorded
+	if cmd, err := app.RunCmd(RunVars{Port: 8001}); err == nil {
+		t.Errorf("expected an error for a deploy without a target, got %q", cmd)
+	}
+}
+
+func TestNestedGroupsAndTags(t *testing.T) {
+	app, err := applicationFromData(true, []byte(`{
+  "Name": "MyApp",
+  "BuildCmd": "./build.sh",
+  "BuildOutputDir": "./build",
+  "RunCmd": "node app.js %PORT%",
+  "HealthEndpoint": "/status",
+  "Targets": {
+    "syd1": {"Ssh": "syd1", "Base": 8000, "Tags": ["sydney", "web"]},
+    "syd2": {"Ssh": "syd2", "Base": 8000, "Tags": ["sydney"]},
+    "mel1": {"Ssh": "mel1", "Base": 8000, "Tags": ["web"]},
+    "lon1": {"Ssh": "lon1", "Base": 8000}
+  },
+  "GroupTargets": {
+    "australia": ["tag:sydney", "mel1"],
+    "everywhere": ["australia", "lon1", "syd1"]
+  }
+}`))
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+
+	tests := []struct {
+		name     TargetName
+		expected string
+	}{
+		{"syd2", "syd2"},
+		{"tag:sydney", "syd1,syd2"},
+		{"tag:web", "mel1,syd1"},
+		{"tag:none", ""},
+		{"australia", "syd1,syd2,mel1"},
+		{"everywhere", "syd1,syd2,mel1,lon1"},
+		{"nowhere", ""},
+	}
+	for _, test := range tests {
+		names := []TargetName{}
+		for _, target := range app.Targets(test.name) {
+			names = append(names, target.Name)
+		}
+		if actual := joinTargetNames(names, ","); actual != test.expected {
+			t.Errorf("expected %s to select '%s', got '%s'", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestGroupCycle(t *testing.T) {
+	_, err := applicationFromData(true, []byte(`{
+  "Name": "MyApp",
+  "BuildCmd": "./build.sh",
+  "BuildOutputDir": "./build",
+  "RunCmd": "node app.js %PORT%",
+  "HealthEndpoint": "/status",
+  "Targets": {"prod": {"Ssh": "localhost", "Base": 8000}},
+  "GroupTargets": {
+    "a": ["prod", "b"],
+    "b": ["c"],
+    "c": ["a"]
+  }
+}`))
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected exactly one problem, got %v", err)
+	}
+	if errs[0] != "Groups refer to each other in a cycle: a -> b -> c -> a" {
+		t.Errorf("unexpected problem: %s", errs[0])
+	}
+}
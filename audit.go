@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+)
+
+// Every change made to the server's deploys, through its rpcs or by the
+// enforce loop restarting deploys, is appended to audit.log in its root as
+// a line of JSON, so that 'camus history' can tell who did what and when.
+// So are rpcs naming a deploy that can't be found, including reading its
+// logs.
+// Who made an rpc is as the client says: the server can't tell behind the
+// ssh tunnel.
+
+const auditLogFileName = "audit.log"
+
+// Audited actions
+const (
+	auditRun         = "run"
+	auditStop        = "stop"
+	auditSet         = "set"
+	auditKillUnknown = "kill-unknown"
+	auditShutdown    = "shutdown"
+	auditPrune       = "prune"
+	auditPin         = "pin"
+	auditUnpin       = "unpin"
+	auditRestart     = "restart"
+
+	// only audited when the deploy can't be found, see resolveDeployId
+	auditLogs = "logs"
+
+	// a post hook failed, see runPostHook
+	auditHook = "hook"
+)
+
+// Caller identifies who made an rpc.
+type Caller struct {
+	User string
+	Host string
+}
+
+// newCaller identifies us, for the rpcs we make.
+func newCaller() Caller {
+	caller := Caller{User: os.Getenv("USER")}
+	if u, err := user.Current(); err == nil {
+		caller.User = u.Username
+	}
+	caller.Host, _ = os.Hostname()
+	return caller
+}
+
+// String returns user@host, or "camus" for the server itself.
+func (c Caller) String() string {
+	if c.User == "" && c.Host == "" {
+		return "camus"
+	}
+	return c.User + "@" + c.Host
+}
+
+type AuditEntry struct {
+	Time time.Time
+
+	// Empty for the server itself, e.g. the enforce loop
+	Caller Caller
+
+	Action   string
+	DeployId string `json:",omitempty"`
+	Port     int    `json:",omitempty"`
+
+	// e.g. the process restarted, or the deploys pruned
+	Detail string `json:",omitempty"`
+
+	// Why the action failed, "" if it succeeded
+	Error string `json:",omitempty"`
+
+	// The target of the server it's from, filled in by the client
+	Target TargetName `json:"-"`
+}
+
+// audit appends an entry for the action to the audit log. err is the
+// outcome of the action.
+func (s *ServerImpl) audit(caller Caller, action string, deployId string, port int,
+	detail string, err error) {
+	entry := &AuditEntry{
+		Time:     time.Now().UTC(),
+		Caller:   caller,
+		Action:   action,
+		DeployId: deployId,
+		Port:     port,
+		Detail:   detail,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	data, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		log.Printf("audit %s: %s\n", action, jsonErr)
+		return
+	}
+
+	s.auditLock.Lock()
+	defer s.auditLock.Unlock()
+	f, openErr := os.OpenFile(path.Join(s.root, auditLogFileName),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if openErr != nil {
+		log.Printf("audit %s: %s\n", action, openErr)
+		return
+	}
+	defer f.Close()
+	// a single write, so entries aren't interleaved
+	if _, writeErr := f.Write(append(data, '\n')); writeErr != nil {
+		log.Printf("audit %s: %s\n", action, writeErr)
+	}
+}
+
+// auditPrune records the deploys removed by a prune.
+func (s *ServerImpl) auditPrune(caller Caller, policy RetentionPolicy,
+	decisions []*PruneDecision, err error) {
+	removed := []string{}
+	for _, d := range decisions {
+		if d.Removed {
+			removed = append(removed, d.Id)
+		}
+	}
+	if len(removed) == 0 && err == nil {
+		return
+	}
+	s.audit(caller, auditPrune, "", 0,
+		fmt.Sprintf("%s: %s", policy, strings.Join(removed, ", ")), err)
+}
+
+// History returns the entries of the audit log from since until until
+// (either zero for no limit) about deployId ("" for all), oldest first.
+func (s *ServerImpl) History(since time.Time, until time.Time, deployId string) ([]*AuditEntry, error) {
+	s.auditLock.Lock()
+	defer s.auditLock.Unlock()
+
+	entries := []*AuditEntry{}
+	f, err := os.Open(path.Join(s.root, auditLogFileName))
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		entry := &AuditEntry{}
+		if err := json.Unmarshal([]byte(line), entry); err != nil {
+			// e.g. a line cut short by a crash
+			log.Printf("history: skipping %q: %s\n", line, err)
+			continue
+		}
+		if !since.IsZero() && entry.Time.Before(since) ||
+			!until.IsZero() && entry.Time.After(until) ||
+			deployId != "" && entry.DeployId != deployId {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// deployOnPort returns the deploy configured to run on port, "" if none.
+func (s *ServerImpl) deployOnPort(port int) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.config.Ports[port]
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditHistory(t *testing.T) {
+	root, err := ioutil.TempDir("", "camus-root-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+	s := &ServerImpl{root: root}
+
+	if entries, err := s.History(time.Time{}, time.Time{}, ""); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no history yet, got %v, %v", entries, err)
+	}
+
+	alice := Caller{User: "alice", Host: "laptop"}
+	s.audit(alice, auditRun, "happy-paris", 8001, "", nil)
+	start := time.Now()
+	s.audit(alice, auditSet, "happy-paris", 0, "", nil)
+	s.audit(Caller{}, auditRestart, "angry-rome", 8002, "worker", errors.New("Unknown user"))
+
+	// a line cut short by a crash is skipped
+	f, _ := os.OpenFile(path.Join(root, auditLogFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"Time": "2016-`)
+	f.Close()
+
+	entries, err := s.History(time.Time{}, time.Time{}, "")
+	if err != nil {
+		t.Fatalf("history: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Action != auditRun || e.Caller != alice ||
+		e.DeployId != "happy-paris" || e.Port != 8001 || e.Error != "" {
+		t.Errorf("unexpected first entry %+v", e)
+	}
+	if e := entries[2]; e.Caller.String() != "camus" || e.Detail != "worker" ||
+		e.Error != "Unknown user" {
+		t.Errorf("unexpected last entry %+v", e)
+	}
+
+	entries, _ = s.History(start, time.Time{}, "")
+	if len(entries) != 2 || entries[0].Action != auditSet {
+		t.Errorf("expected the entries since the set, got %d", len(entries))
+	}
+	entries, _ = s.History(time.Time{}, start, "")
+	if len(entries) != 1 || entries[0].Action != auditRun {
+		t.Errorf("expected the entries until the set, got %d", len(entries))
+	}
+	entries, _ = s.History(time.Time{}, time.Time{}, "angry-rome")
+	if len(entries) != 1 || entries[0].Action != auditRestart {
+		t.Errorf("expected the entries about angry-rome, got %d", len(entries))
+	}
+}
+
+func TestAuditUnknownDeploy(t *testing.T) {
+	rpc := &RpcServer{server: newTestServer(t)}
+	alice := Caller{User: "alice", Host: "laptop"}
+
+	if err := rpc.Run(RunRequest{DeployId: "angry-rome", Caller: alice}, &RunReply{}); err == nil {
+		t.Fatalf("expected running an unknown deploy to fail")
+	}
+	rpc.StopDeploy(StopDeployRequest{DeployId: "angry-rome", Caller: alice}, &StopDeployResponse{})
+	rpc.Pin(PinRequest{DeployId: "angry-rome", Caller: alice}, &PinReply{})
+	rpc.Logs(LogsRequest{DeployId: "angry-rome", Caller: alice}, &LogsReply{})
+
+	entries, err := rpc.server.History(time.Time{}, time.Time{}, "")
+	if err != nil {
+		t.Fatalf("history: %s", err)
+	}
+	actions := []string{}
+	for _, e := range entries {
+		if e.DeployId != "angry-rome" || e.Caller != alice || e.Error == "" {
+			t.Errorf("expected alice's failure on angry-rome, got %+v", e)
+		}
+		actions = append(actions, e.Action)
+	}
+	if strings.Join(actions, ",") != "run,stop,unpin,logs" {
+		t.Errorf("expected run, stop, unpin and logs audited, got %v", actions)
+	}
+}
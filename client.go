@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
@@ -8,8 +9,10 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Client interface {
@@ -22,8 +25,19 @@ type Client interface {
 	SetActiveById(string) error
 
 	ListDeploys() ([]*Deploy, error)
-	Stop(deployId string) error
-	KillUnknownProcesses()
+	Logs(req LogsRequest) (*LogsReply, error)
+
+	// Stop stops the deploy, reporting how each of its processes ended.
+	// force skips its pre-stop hook.
+	Stop(deployId string, force bool) ([]*StopResult, error)
+	KillUnknownProcesses() ([]*StopResult, error)
+
+	// Prune removes old deploys, see RetentionPolicy
+	Prune(policy RetentionPolicy, dryRun bool) ([]*PruneDecision, error)
+	Pin(deployId string, pinned bool) error
+
+	// History returns the server's audit log, oldest first, see AuditEntry
+	History(req HistoryRequest) ([]*AuditEntry, error)
 	Shutdown()
 }
 
@@ -33,24 +47,42 @@ type SingleTargetClient struct {
 	target        *Target
 	appDir        string
 	serverChannel TargetBox
+
+	// where the config was loaded from, to merge this target's overlays
+	// into the deploy.json it's pushed with
+	deployFile  string
+	isLocalTest bool
+
+	// how long the last Build took, recorded in the pushed DeployMeta
+	buildDuration time.Duration
+
+	// who we tell the server is making changes, for its audit log
+	caller Caller
 }
 
 // Client which communicates with multiple underlying servers at once. Used if
 // the target is actually a group of servers
 type MultiTargetClient struct {
-	app     Application
-	appDir  string
-	clients []Client
+	app        Application
+	appDir     string
+	targetName TargetName
+	clients    []Client
 }
 
 func NewClient(deployFile string, targetName TargetName, isLocalTest bool) (*MultiTargetClient, error) {
-	app, err := ApplicationFromConfig(true, deployFile)
+	config, _, err := loadConfigLayers(deployFile, targetName, isLocalTest)
+	if err != nil {
+		return nil, err
+	}
+	app, err := applicationFromData(true, config)
 	if err != nil {
 		return nil, err
 	}
 
 	appDir := path.Dir(deployFile)
 
+	caller := newCaller()
+
 	// Create all SingleTargetClients
 	clients := []Client{}
 	for _, target := range app.Targets(targetName) {
@@ -85,6 +117,9 @@ func NewClient(deployFile string, targetName TargetName, isLocalTest bool) (*Mul
 			target:        target,
 			appDir:        appDir,
 			serverChannel: serverChannel,
+			deployFile:    deployFile,
+			isLocalTest:   isLocalTest,
+			caller:        caller,
 		})
 	}
 
@@ -93,14 +128,20 @@ func NewClient(deployFile string, targetName TargetName, isLocalTest bool) (*Mul
 	}
 
 	return &MultiTargetClient{
-		app:     app,
-		appDir:  path.Dir(deployFile),
-		clients: clients,
+		app:        app,
+		appDir:     path.Dir(deployFile),
+		targetName: targetName,
+		clients:    clients,
 	}, nil
 }
 
 func (c *SingleTargetClient) Build() error {
-	return build(c.app.BuildCmd(), c.appDir)
+	started := time.Now()
+	if err := build(c.app.BuildCmd(c.target.Name), c.appDir); err != nil {
+		return err
+	}
+	c.buildDuration = time.Since(started)
+	return nil
 }
 
 func (c *SingleTargetClient) Push(deployId string) error {
@@ -112,6 +153,13 @@ func (c *SingleTargetClient) Push(deployId string) error {
 		return err
 	}
 
+	// the target's own overlays, which for a group differ from member to
+	// member
+	config, layers, err := loadConfigLayers(c.deployFile, c.target.Name, c.isLocalTest)
+	if err != nil {
+		return err
+	}
+
 	c.info("uploading package...")
 
 	localDeployDir := c.app.BuildOutputDir()
@@ -128,7 +176,38 @@ func (c *SingleTargetClient) Push(deployId string) error {
 
 	c.info("done uploading")
 
-	postDeployCmd := c.app.PostDeployCmd()
+	// Record which target this deploy is for, so the server can apply
+	// target specific settings (e.g. Env) when running it
+	targetFile := path.Join(remoteDeployDir, deployTargetFileName)
+	if err := c.serverChannel.Exec(
+		fmt.Sprintf("echo '%s' > %s", c.target.Name, targetFile)); err != nil {
+		return err
+	}
+
+	meta, err := json.MarshalIndent(newDeployMeta(c.appDir, c.buildDuration), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := c.writeRemoteFile(path.Join(remoteDeployDir, deployMetaFileName), meta); err != nil {
+		return err
+	}
+
+	// so the server runs the deploy with the overlays applied
+	if len(layers) > 1 {
+		configFile := path.Join(remoteDeployDir, deployConfigFileName)
+		if err := c.writeRemoteFile(configFile, config); err != nil {
+			return err
+		}
+	}
+
+	postDeployCmd := c.app.PostDeployCmd(RunVars{
+		DeployId:   deployId,
+		DeployDir:  remoteDeployDir,
+		Target:     c.target.Name,
+		ServerRoot: path.Dir(reply.Path),
+		FrontPort:  c.target.Base + 98,
+		Vars:       c.app.Vars(),
+	})
 	if postDeployCmd != "" {
 		cmd := fmt.Sprintf("cd %s; %s", remoteDeployDir, postDeployCmd)
 		if err := c.serverChannel.Exec(cmd); err != nil {
@@ -140,8 +219,14 @@ func (c *SingleTargetClient) Push(deployId string) error {
 	return nil
 }
 
+// writeRemoteFile writes data to file on the server.
+func (c *SingleTargetClient) writeRemoteFile(file string, data []byte) error {
+	return c.serverChannel.Exec(fmt.Sprintf("printf '%%s' %s > %s",
+		shellQuote(string(data)), file))
+}
+
 func (c *SingleTargetClient) Run(deployId string) error {
-	req := &RunRequest{deployId}
+	req := &RunRequest{DeployId: deployId, Caller: c.caller}
 	var reply RunReply
 	err := c.client.Call("RpcServer.Run", req, &reply)
 	if err != nil {
@@ -151,14 +236,18 @@ func (c *SingleTargetClient) Run(deployId string) error {
 	return nil
 }
 
-func (c *SingleTargetClient) Stop(deployId string) error {
-	req := &StopDeployRequest{deployId}
+func (c *SingleTargetClient) Stop(deployId string, force bool) ([]*StopResult, error) {
+	req := &StopDeployRequest{DeployId: deployId, Caller: c.caller, Force: force}
 	var reply StopDeployResponse
-	return c.client.Call("RpcServer.StopDeploy", &req, &reply)
+	if err := c.client.Call("RpcServer.StopDeploy", &req, &reply); err != nil {
+		return nil, err
+	}
+
+	return reply.Results, nil
 }
 
 func (c *SingleTargetClient) SetActiveByPort(port int) error {
-	req := &SetActivePortRequest{port}
+	req := &SetActivePortRequest{Port: port, Caller: c.caller}
 	var reply SetActivePortReply
 	err := c.client.Call("RpcServer.SetActiveByPort", req, &reply)
 	if err != nil {
@@ -169,7 +258,7 @@ func (c *SingleTargetClient) SetActiveByPort(port int) error {
 }
 
 func (c *SingleTargetClient) SetActiveById(deployId string) error {
-	req := &SetActiveByIdRequest{deployId}
+	req := &SetActiveByIdRequest{Id: deployId, Caller: c.caller}
 	var reply SetActiveByIdReply
 	err := c.client.Call("RpcServer.SetActiveById", req, &reply)
 	if err != nil {
@@ -189,6 +278,44 @@ func (c *SingleTargetClient) ListDeploys() ([]*Deploy, error) {
 	return reply.Deploys, nil
 }
 
+func (c *SingleTargetClient) Logs(req LogsRequest) (*LogsReply, error) {
+	req.Caller = c.caller
+	var reply LogsReply
+	if err := c.client.Call("RpcServer.Logs", &req, &reply); err != nil {
+		return nil, err
+	}
+
+	return &reply, nil
+}
+
+func (c *SingleTargetClient) Prune(policy RetentionPolicy, dryRun bool) ([]*PruneDecision, error) {
+	req := &PruneRequest{Policy: policy, DryRun: dryRun, Caller: c.caller}
+	var reply PruneReply
+	if err := c.client.Call("RpcServer.Prune", req, &reply); err != nil {
+		return nil, err
+	}
+
+	return reply.Decisions, nil
+}
+
+func (c *SingleTargetClient) Pin(deployId string, pinned bool) error {
+	req := &PinRequest{DeployId: deployId, Pinned: pinned, Caller: c.caller}
+	var reply PinReply
+	return c.client.Call("RpcServer.Pin", req, &reply)
+}
+
+func (c *SingleTargetClient) History(req HistoryRequest) ([]*AuditEntry, error) {
+	var reply HistoryReply
+	if err := c.client.Call("RpcServer.History", &req, &reply); err != nil {
+		return nil, err
+	}
+	for _, entry := range reply.Entries {
+		entry.Target = c.target.Name
+	}
+
+	return reply.Entries, nil
+}
+
 func (c *SingleTargetClient) info(args ...interface{}) {
 	log.Println(prepend("    client: ", args)...)
 }
@@ -197,30 +324,39 @@ func prepend(item interface{}, items []interface{}) []interface{} {
 	return append([]interface{}{item}, items...)
 }
 
+// shellQuote quotes s as a single word for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 func getFreeLocalPort() (port int) {
 	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
-		log.Fatalf("Couldn't get free local port (to setup ssh tunnel)", err)
+		log.Fatalf("Couldn't get free local port (to setup ssh tunnel): %s", err)
 	}
 	parts := strings.Split(l.Addr().String(), ":")
 	l.Close()
 
 	port, err = strconv.Atoi(parts[len(parts)-1])
 	if err != nil {
-		log.Fatalf("Couldn't parse port from", parts[len(parts)-1], err)
+		log.Fatalf("Couldn't parse port from %s: %s", parts[len(parts)-1], err)
 	}
 
 	return
 }
 
-func (c *SingleTargetClient) KillUnknownProcesses() {
-	var args KillUnknownProcessesRequest
+func (c *SingleTargetClient) KillUnknownProcesses() ([]*StopResult, error) {
+	args := KillUnknownProcessesRequest{Caller: c.caller}
 	var reply KillUnknownProcessesResponse
-	c.client.Call("RpcServer.KillUnknownProcesses", &args, &reply)
+	if err := c.client.Call("RpcServer.KillUnknownProcesses", &args, &reply); err != nil {
+		return nil, err
+	}
+
+	return reply.Results, nil
 }
 
 func (c *SingleTargetClient) Shutdown() {
-	var args ShutdownRequest
+	args := ShutdownRequest{Caller: c.caller}
 	var reply ShutdownResponse
 	c.client.Call("RpcServer.Shutdown", &args, &reply)
 }
@@ -228,7 +364,28 @@ func (c *SingleTargetClient) Shutdown() {
 // MultiTargetClient
 
 func (c *MultiTargetClient) Build() error {
-	return build(c.app.BuildCmd(), c.appDir)
+	// The same build is pushed to every target, so they must agree on
+	// how it is built
+	buildCmd := ""
+	for _, target := range c.app.Targets(c.targetName) {
+		cmd := c.app.BuildCmd(target.Name)
+		if buildCmd != "" && cmd != buildCmd {
+			return fmt.Errorf("Targets in '%s' have different BuildCmds, "+
+				"deploy to them separately", c.targetName)
+		}
+		buildCmd = cmd
+	}
+
+	started := time.Now()
+	if err := build(buildCmd, c.appDir); err != nil {
+		return err
+	}
+	for _, client := range c.clients {
+		if single, ok := client.(*SingleTargetClient); ok {
+			single.buildDuration = time.Since(started)
+		}
+	}
+	return nil
 }
 
 func (c *MultiTargetClient) Push(deployId string) error {
@@ -251,14 +408,18 @@ func (c *MultiTargetClient) Run(deployId string) error {
 	return nil
 }
 
-func (c *MultiTargetClient) Stop(deployId string) error {
+func (c *MultiTargetClient) Stop(deployId string, force bool) ([]*StopResult, error) {
+	var results []*StopResult
+
 	for _, c := range c.clients {
-		if err := c.Stop(deployId); err != nil {
-			return err
+		if resultsForServer, err := c.Stop(deployId, force); err != nil {
+			return nil, err
+		} else {
+			results = append(results, resultsForServer...)
 		}
 	}
 
-	return nil
+	return results, nil
 }
 
 func (c *MultiTargetClient) SetActiveByPort(port int) error {
@@ -295,10 +456,70 @@ func (c *MultiTargetClient) ListDeploys() ([]*Deploy, error) {
 	return deploys, nil
 }
 
-func (c *MultiTargetClient) KillUnknownProcesses() {
+func (c *MultiTargetClient) Logs(req LogsRequest) (*LogsReply, error) {
+	// Only makes sense if you are connecting to a single backend
+	// server
+	if len(c.clients) > 1 {
+		return nil, fmt.Errorf("Cannot show logs when target is a group of machines, " +
+			"use -target to pick one of them")
+	}
+
+	return c.clients[0].Logs(req)
+}
+
+func (c *MultiTargetClient) Prune(policy RetentionPolicy, dryRun bool) ([]*PruneDecision, error) {
+	var decisions []*PruneDecision
+
+	for _, c := range c.clients {
+		if decisionsForServer, err := c.Prune(policy, dryRun); err != nil {
+			return nil, err
+		} else {
+			decisions = append(decisions, decisionsForServer...)
+		}
+	}
+
+	return decisions, nil
+}
+
+func (c *MultiTargetClient) Pin(deployId string, pinned bool) error {
 	for _, c := range c.clients {
-		c.KillUnknownProcesses()
+		if err := c.Pin(deployId, pinned); err != nil {
+			return err
+		}
 	}
+
+	return nil
+}
+
+func (c *MultiTargetClient) History(req HistoryRequest) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+
+	for _, c := range c.clients {
+		if entriesForServer, err := c.History(req); err != nil {
+			return nil, err
+		} else {
+			entries = append(entries, entriesForServer...)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+
+	return entries, nil
+}
+
+func (c *MultiTargetClient) KillUnknownProcesses() ([]*StopResult, error) {
+	var results []*StopResult
+
+	for _, c := range c.clients {
+		if resultsForServer, err := c.KillUnknownProcesses(); err != nil {
+			return nil, err
+		} else {
+			results = append(results, resultsForServer...)
+		}
+	}
+
+	return results, nil
 }
 
 func (c *MultiTargetClient) Shutdown() {
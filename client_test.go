@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// serveTestServer serves s's rpcs on a free local port, returning it.
+func serveTestServer(t *testing.T, s *ServerImpl) int {
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.Register(&RpcServer{s}); err != nil {
+		t.Fatalf("register rpcs: %s", err)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go http.Serve(l, rpcServer)
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// fakeRsync puts an rsync that just copies on the PATH, if there isn't a
+// real one. It's enough for pushing to fresh dirs.
+func fakeRsync(t *testing.T) {
+	if _, err := exec.LookPath("rsync"); err == nil {
+		return
+	}
+	bin, err := ioutil.TempDir("", "camus-bin-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(bin) })
+	script := `#!/bin/sh
+for arg; do src=$dst; dst=$arg; done
+mkdir -p "$dst" && cp -a "$src". "$dst"
+`
+	if err := ioutil.WriteFile(path.Join(bin, "rsync"), []byte(script), 0755); err != nil {
+		t.Fatalf("write rsync: %s", err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+}
+
+func TestPushGroupAppliesEachTargetsOverlays(t *testing.T) {
+	fakeRsync(t)
+	syd1 := newTestServer(t)
+	syd2 := newTestServer(t)
+
+	appDir, err := ioutil.TempDir("", "camus-app-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(appDir)
+
+	config := fmt.Sprintf(`{
+  "Name": "MyApp",
+  "BuildCmd": "true",
+  "BuildOutputDir": "./build",
+  "RunCmd": "node app.js %%PORT%%",
+  "HealthEndpoint": "/status",
+  "Targets": {
+    "syd1": {"Ssh": "syd1", "Base": %d},
+    "syd2": {"Ssh": "syd2", "Base": %d}
+  },
+  "GroupTargets": {
+    "australia": ["syd1", "syd2"]
+  }
+}`, serveTestServer(t, syd1), serveTestServer(t, syd2))
+	files := map[string]string{
+		"deploy.json":           config,
+		"deploy.australia.json": `{"RunCmd": "node australia.js %PORT%"}`,
+		"deploy.syd1.json":      `{"RunCmd": "node syd1.js %PORT%"}`,
+		"build/deploy.json":     config,
+		"build/app.js":          "",
+	}
+	if err := os.Mkdir(path.Join(appDir, "build"), 0755); err != nil {
+		t.Fatalf("create build dir: %s", err)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(appDir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+
+	client, err := NewClient(path.Join(appDir, "deploy.json"), "australia", true)
+	if err != nil {
+		t.Fatalf("new client: %s", err)
+	}
+	if err := client.Push("d1"); err != nil {
+		t.Fatalf("push: %s", err)
+	}
+
+	expected := []struct {
+		server *ServerImpl
+		target string
+		runCmd string
+	}{
+		{syd1, "syd1", "node syd1.js %PORT%"},
+		// no overlay of its own, and the group's isn't for it
+		{syd2, "syd2", "node app.js %PORT%"},
+	}
+	for _, e := range expected {
+		data, err := ioutil.ReadFile(e.server.deployConfigFile("d1"))
+		if err != nil {
+			t.Fatalf("read %s's deployed config: %s", e.target, err)
+		}
+		if !strings.Contains(string(data), `"RunCmd": "`+e.runCmd+`"`) {
+			t.Errorf("expected %s's deployed config to have RunCmd %q, got %s",
+				e.target, e.runCmd, data)
+		}
+		data, err = ioutil.ReadFile(path.Join(e.server.deployDir("d1"), deployTargetFileName))
+		if err != nil {
+			t.Fatalf("read %s's deployed target: %s", e.target, err)
+		}
+		if actual := strings.TrimSpace(string(data)); actual != e.target {
+			t.Errorf("expected the deploy to be for %s, got %s", e.target, actual)
+		}
+		if meta := e.server.deployMeta("d1"); meta == nil || meta.CamusVersion != version {
+			t.Errorf("expected %s's deploy to have its metadata, got %+v", e.target, meta)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path.Join(appDir, "build/deploy.json"))
+	if err != nil {
+		t.Fatalf("read build output: %s", err)
+	}
+	if string(data) != config {
+		t.Errorf("expected the build output's deploy.json left alone, got %s", data)
+	}
+	if _, err := os.Stat(path.Join(appDir, "build", deployMetaFileName)); !os.IsNotExist(err) {
+		t.Errorf("expected no metadata written into the build output")
+	}
+}
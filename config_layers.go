@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// A deploy.json may be layered with overlay files next to it, which are
+// deep-merged over it in order:
+//
+//   deploy.<target>.json  for the target given with -target
+//   deploy.local.json     personal overrides, not meant to be committed
+//
+// The local overlay only applies to the "local" target and to clients run
+// with -is-local-test, so personal overrides are never pushed to real
+// servers.
+//
+// Objects are merged key by key, any other value (including arrays)
+// replaces the one beneath it, and a null removes the key.
+
+const localOverlayName = "local"
+
+// overlayFile returns the name of an overlay of file, e.g. deploy.json,
+// prod -> deploy.prod.json
+func overlayFile(file string, name string) string {
+	ext := path.Ext(file)
+	return strings.TrimSuffix(file, ext) + "." + name + ext
+}
+
+// configLayers returns file followed by those of its overlays that exist
+// for the given target ("" for none).
+func configLayers(file string, target TargetName, isLocalTest bool) []string {
+	layers := []string{file}
+	names := []string{}
+	if target != "" && string(target) != localOverlayName {
+		names = append(names, string(target))
+	}
+	if isLocalTest || string(target) == localOverlayName {
+		names = append(names, localOverlayName)
+	}
+	for _, name := range names {
+		overlay := overlayFile(file, name)
+		if _, err := os.Stat(overlay); err == nil {
+			layers = append(layers, overlay)
+		}
+	}
+	return layers
+}
+
+// loadConfigLayers reads file and its overlays for target, returning the
+// merged config. If there are no overlays the data of file is returned as
+// is, so that error positions refer to it.
+func loadConfigLayers(file string, target TargetName, isLocalTest bool) ([]byte, []string, error) {
+	layers := configLayers(file, target, isLocalTest)
+	data, err := ioutil.ReadFile(layers[0])
+	if err != nil || len(layers) == 1 {
+		return data, layers, err
+	}
+
+	var merged interface{}
+	for _, layer := range layers {
+		data, err := ioutil.ReadFile(layer)
+		if err != nil {
+			return nil, nil, err
+		}
+		var value interface{}
+		if err := unmarshalConfig(data, &value); err != nil {
+			return nil, nil, ConfigErrors{fmt.Sprintf("%s: Invalid json, %s", layer, err)}
+		}
+		if dups := findDuplicateKeys(data); len(dups) > 0 {
+			errs := ConfigErrors{}
+			for _, key := range dups {
+				errs = append(errs, fmt.Sprintf("%s: Duplicate key %s", layer, key))
+			}
+			return nil, nil, errs
+		}
+		merged = mergeConfig(merged, value)
+	}
+
+	data, err = json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, layers, nil
+}
+
+// mergeConfig deep-merges overlay over base (as decoded by encoding/json).
+func mergeConfig(base interface{}, overlay interface{}) interface{} {
+	baseObj, baseIsObj := base.(map[string]interface{})
+	overlayObj, overlayIsObj := overlay.(map[string]interface{})
+	if !baseIsObj || !overlayIsObj {
+		return overlay
+	}
+
+	merged := map[string]interface{}{}
+	for key, value := range baseObj {
+		merged[key] = value
+	}
+	for key, value := range overlayObj {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = mergeConfig(merged[key], value)
+		}
+	}
+	return merged
+}
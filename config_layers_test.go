@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestConfigLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camus-layers-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"deploy.json": `{
+  "Name": "MyApp",
+  "BuildCmd": "./build.sh",
+  "BuildOutputDir": "./build",
+  "PostDeployCmd": "./migrate.sh",
+  "RunCmd": "node app.js %PORT%",
+  "HealthEndpoint": "/status",
+  "Env": {"LOG_LEVEL": "info", "CACHE": "on"},
+  "Targets": {
+    "prod": {"Ssh": "prod.example.com", "Base": 8000},
+    "local": {"Ssh": "localhost", "Base": 8000}
+  }
+}`,
+		"deploy.prod.json": `{
+  # prod only
+  "Env": {"LOG_LEVEL": "warn"},
+}`,
+		"deploy.local.json": `{
+  "PostDeployCmd": null,
+  "Env": {"CACHE": "off"}
+}`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+	file := path.Join(dir, "deploy.json")
+
+	_, layers, err := loadConfigLayers(file, "prod", false)
+	if err != nil {
+		t.Fatalf("load layers: %s", err)
+	}
+	if len(layers) != 2 || path.Base(layers[1]) != "deploy.prod.json" {
+		t.Errorf("unexpected layers %v", layers)
+	}
+
+	app, err := ApplicationFromConfig(true, file, "prod")
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+	env := app.Env("prod")
+	if env["LOG_LEVEL"] != "warn" || env["CACHE"] != "on" {
+		t.Errorf("expected only the prod overlay to be merged into Env, got %v", env)
+	}
+	if cmd := app.PostDeployCmd(RunVars{}); cmd != "./migrate.sh" {
+		t.Errorf("expected the local overlay not to apply to prod, got PostDeployCmd '%s'", cmd)
+	}
+	if cmd := app.BuildCmd("prod"); cmd != "./build.sh" {
+		t.Errorf("expected base BuildCmd to be kept, got '%s'", cmd)
+	}
+
+	// testing locally against the prod config
+	data, layers, err := loadConfigLayers(file, "prod", true)
+	if err != nil {
+		t.Fatalf("load layers: %s", err)
+	}
+	if len(layers) != 3 || path.Base(layers[1]) != "deploy.prod.json" ||
+		path.Base(layers[2]) != "deploy.local.json" {
+		t.Errorf("unexpected layers %v", layers)
+	}
+	app, err = applicationFromData(true, data)
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+	if env := app.Env("prod"); env["LOG_LEVEL"] != "warn" || env["CACHE"] != "off" {
+		t.Errorf("expected overlays to be merged into Env, got %v", env)
+	}
+	if cmd := app.PostDeployCmd(RunVars{}); cmd != "" {
+		t.Errorf("expected null to remove PostDeployCmd, got '%s'", cmd)
+	}
+
+	app, err = ApplicationFromConfig(true, file, "local")
+	if err != nil {
+		t.Fatalf("load config: %s", err)
+	}
+	if env := app.Env("local"); env["LOG_LEVEL"] != "info" || env["CACHE"] != "off" {
+		t.Errorf("expected only the local overlay to apply to local, got %v", env)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A process that keeps failing is restarted less and less often, rather
+// than every restartDelay by its Runner (or every enforce, when it can't be
+// started at all) forever. Each consecutive failure doubles the delay, up to
+// maxRestartDelay, and after crashLoopThreshold of them the process is
+// reported as crash looping in 'camus list'. Once a process has stayed up
+// for stableRunTime its earlier failures are forgotten.
+
+const (
+	maxRestartDelay    = 5 * time.Minute
+	crashLoopThreshold = 5
+	stableRunTime      = time.Minute
+)
+
+// restartBackoff tracks the consecutive failures of a process to start or
+// keep running.
+type restartBackoff struct {
+	failures int
+	lastErr  error
+
+	// when it may next be restarted
+	next time.Time
+}
+
+// failed records a failure because of err, returning how long to wait
+// before restarting.
+func (b *restartBackoff) failed(err error) time.Duration {
+	b.failures++
+	b.lastErr = err
+	delay := restartDelay
+	for i := 1; i < b.failures && delay < maxRestartDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRestartDelay {
+		delay = maxRestartDelay
+	}
+	b.next = time.Now().Add(delay)
+	return delay
+}
+
+func (b *restartBackoff) reset() {
+	*b = restartBackoff{}
+}
+
+// waiting is true until it's time to restart.
+func (b *restartBackoff) waiting() bool {
+	return time.Now().Before(b.next)
+}
+
+func (b *restartBackoff) crashLooping() bool {
+	return b.failures >= crashLoopThreshold
+}
+
+// String describes the failures, for Deploy.Errors.
+func (b *restartBackoff) String() string {
+	wait := time.Until(b.next)
+	if wait < 0 {
+		wait = 0
+	}
+	return fmt.Sprintf("Crash looping, failed %d times in a row (last: %s), next restart in %s",
+		b.failures, b.lastErr, wait.Round(time.Second))
+}
+
+// startFailed records that the process supervised under key couldn't be
+// started by the enforce loop, and when to try again. The caller holds
+// s.lock.
+func (s *ServerImpl) startFailed(key string, err error) time.Duration {
+	b, ok := s.startFailures[key]
+	if !ok {
+		b = &restartBackoff{}
+		s.startFailures[key] = b
+	}
+	delay := b.failed(err)
+	if delay < s.enforceDelay {
+		delay = s.enforceDelay
+	}
+	return delay
+}
+
+// startBackedOff is true if the enforce loop should leave starting the
+// process supervised under key until later. The caller holds s.lock.
+func (s *ServerImpl) startBackedOff(key string) bool {
+	b, ok := s.startFailures[key]
+	return ok && b.waiting()
+}
+
+// forgetStartFailures forgets the failures of the deploy's processes, e.g.
+// when it's explicitly run or stopped. The caller holds s.lock.
+func (s *ServerImpl) forgetStartFailures(deployId string) {
+	for key := range s.startFailures {
+		if key == deployId || strings.HasPrefix(key, deployId+"/") {
+			delete(s.startFailures, key)
+		}
+	}
+}
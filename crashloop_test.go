@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	b := &restartBackoff{}
+	expected := []time.Duration{restartDelay, 2 * restartDelay, 4 * restartDelay}
+	for i, delay := range expected {
+		if got := b.failed(errors.New("exit status 1")); got != delay {
+			t.Errorf("failure %d: expected a delay of %s, got %s", i+1, delay, got)
+		}
+	}
+	if !b.waiting() {
+		t.Errorf("expected to be waiting to restart")
+	}
+	if b.crashLooping() {
+		t.Errorf("didn't expect %d failures to be crash looping", b.failures)
+	}
+
+	for i := 0; i < 20; i++ {
+		b.failed(errors.New("exit status 2"))
+	}
+	if got := b.failed(errors.New("exit status 3")); got != maxRestartDelay {
+		t.Errorf("expected the delay to stop at %s, got %s", maxRestartDelay, got)
+	}
+	if !b.crashLooping() {
+		t.Errorf("expected %d failures to be crash looping", b.failures)
+	}
+	if msg := b.String(); !strings.Contains(msg, "exit status 3") {
+		t.Errorf("expected the last failure in %q", msg)
+	}
+
+	b.reset()
+	if b.waiting() || b.crashLooping() {
+		t.Errorf("expected reset to forget the failures")
+	}
+}
+
+func TestRestartBackoffEnforce(t *testing.T) {
+	s := &ServerImpl{
+		enforceDelay:  5 * time.Second,
+		startFailures: map[string]*restartBackoff{},
+	}
+	key := runnerKey("happy-paris", "worker")
+	if s.startBackedOff(key) {
+		t.Errorf("didn't expect to back off before any failure")
+	}
+	if delay := s.startFailed(key, errors.New("Unknown user")); delay != s.enforceDelay {
+		t.Errorf("expected to wait for the next enforce, got %s", delay)
+	}
+	if !s.startBackedOff(key) {
+		t.Errorf("expected to back off after a failure")
+	}
+	for i := 1; i < crashLoopThreshold; i++ {
+		s.startFailed(key, errors.New("Unknown user"))
+	}
+	if _, errs := s.runnerStatus(key); len(errs) != 1 || !strings.Contains(errs[0], "Unknown user") {
+		t.Errorf("expected a crash loop error, got %v", errs)
+	}
+
+	s.forgetStartFailures("happy-paris")
+	if s.startBackedOff(key) {
+		t.Errorf("expected the failures to be forgotten")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+type Process struct {
+	Port     int
+	Name     string
+	Pid      int
+	DeployId string
+}
+
+// ProcessFinder finds the processes listening on ports, see ProcFinder and
+// LsofFinder.
+type ProcessFinder interface {
+	// Listening returns the processes listening on ports between lowPort
+	// and highPort, without their DeployId.
+	Listening(lowPort, highPort int) ([]Process, error)
+
+	// Cwd returns the current working directory of pid.
+	Cwd(pid int) (string, error)
+}
+
+// processFinder reads /proc where it can, lsof is slower but works on
+// other systems.
+var processFinder = defaultProcessFinder()
+
+func defaultProcessFinder() ProcessFinder {
+	if _, err := os.Stat("/proc/net/tcp"); err == nil {
+		return &ProcFinder{Root: "/proc"}
+	}
+	return &LsofFinder{}
+}
+
+// FindListeningProcesses returns a list of Processes that are listening on
+// ports between lowPort and highPort. It will try and use the current working
+// directory to determine which deployId the running process has.
+func FindListeningProcesses(lowPort, highPort int) []Process {
+	finder := processFinder
+	procs, err := finder.Listening(lowPort, highPort)
+	if err != nil {
+		if _, isLsof := finder.(*LsofFinder); isLsof {
+			log.Printf("Failed to find listening processes: %s\n", err)
+			return []Process{}
+		}
+		log.Printf("Failed to find listening processes, trying lsof: %s\n", err)
+		finder = &LsofFinder{}
+		if procs, err = finder.Listening(lowPort, highPort); err != nil {
+			log.Printf("Failed to find listening processes: %s\n", err)
+			return []Process{}
+		}
+	}
+	for i := range procs {
+		cwd, err := finder.Cwd(procs[i].Pid)
+		if err != nil {
+			log.Printf("Failed to lookup cwd for %d: %s\n", procs[i].Pid, err)
+			continue
+		}
+		procs[i].DeployId = deriveDeployIdFromCwd(cwd)
+	}
+	return procs
+}
+
+func deriveDeployIdFromCwd(cwd string) string {
+	dir, deployId := path.Split(cwd)
+	dir, deploysDir := path.Split(strings.TrimSuffix(dir, "/"))
+	// Check to see if this process is one of ours.
+	// TODO(koz): Make this strict by passing in the server root.
+	if deploysDir != "deploys" {
+		return ""
+	}
+	return deployId
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	httpHealthCheck = "http"
+	tcpHealthCheck  = "tcp"
+	execHealthCheck = "exec"
+
+	// Reported as the health status of tcp and exec checks that pass,
+	// so they read the same as a successful http check in 'camus list'
+	nonHttpHealthyStatus = http.StatusOK
+)
+
+// Defaults used for any HealthCheck settings not given in deploy.json
+var MAX_STARTUP_TIME = time.Duration(20) * time.Second
+var MAX_HEALTH_CHECK_TIME = time.Duration(2) * time.Second
+var STARTUP_HEALTH_CHECK_INTERVAL = time.Duration(100) * time.Millisecond
+
+// HealthCheckDef is the deploy.json form of a health check. Durations are
+// strings as understood by time.ParseDuration, e.g. "500ms" or "2m".
+type HealthCheckDef struct {
+	// One of "http" (the default), "tcp" or "exec"
+	Type string
+
+	// Http path to request, e.g. /status
+	Path string
+
+	// For "exec" checks, the command to run in the deploy dir. The app is
+	// healthy if it exits with status 0. It has the app's Env, and PORT.
+	Cmd string
+
+	// Status codes counted as healthy, defaults to [200]
+	StatusCodes []int
+
+	// optional, the response body must contain this to be healthy
+	BodyContains string
+
+	// optional extra request headers, e.g. {"Host": "myapp.com"}
+	Headers map[string]string
+
+	// Timeout for a single health check request
+	Timeout string
+
+	// Time to wait between checks while the app is starting
+	Interval string
+
+	// How long the app has to become healthy after it is started
+	StartupTimeout string
+}
+
+type HealthCheck struct {
+	Type           string
+	Path           string
+	Cmd            string
+	StatusCodes    []int
+	BodyContains   string
+	Headers        map[string]string
+	Timeout        time.Duration
+	Interval       time.Duration
+	StartupTimeout time.Duration
+
+	// optional, who exec checks run as (defaults to us)
+	Credential *syscall.Credential
+
+	// optional, the environment exec checks run with, as the app's
+	// (defaults to ours with PORT)
+	Env []string
+}
+
+func NewHealthCheck(def HealthCheckDef) (*HealthCheck, error) {
+	hc := &HealthCheck{
+		Type:           def.Type,
+		Path:           def.Path,
+		Cmd:            def.Cmd,
+		StatusCodes:    def.StatusCodes,
+		BodyContains:   def.BodyContains,
+		Headers:        def.Headers,
+		Timeout:        MAX_HEALTH_CHECK_TIME,
+		Interval:       STARTUP_HEALTH_CHECK_INTERVAL,
+		StartupTimeout: MAX_STARTUP_TIME,
+	}
+
+	if len(hc.Type) == 0 {
+		hc.Type = httpHealthCheck
+	}
+
+	switch hc.Type {
+	case httpHealthCheck:
+		if len(hc.Path) == 0 {
+			hc.Path = "/"
+		}
+		if !strings.HasPrefix(hc.Path, "/") {
+			return nil, fmt.Errorf("HealthCheck.Path should start with '/'")
+		}
+		if len(hc.StatusCodes) == 0 {
+			hc.StatusCodes = []int{http.StatusOK}
+		}
+		for _, code := range hc.StatusCodes {
+			if code < 100 || code > 599 {
+				return nil, fmt.Errorf("Invalid HealthCheck.StatusCodes entry %d", code)
+			}
+		}
+	case tcpHealthCheck, execHealthCheck:
+		if len(hc.Path) != 0 || len(hc.StatusCodes) != 0 ||
+			len(hc.BodyContains) != 0 || len(hc.Headers) != 0 {
+			return nil, fmt.Errorf("HealthCheck.Path, StatusCodes, BodyContains and "+
+				"Headers only apply to %s checks", httpHealthCheck)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown HealthCheck.Type '%s', expected %s, %s or %s",
+			hc.Type, httpHealthCheck, tcpHealthCheck, execHealthCheck)
+	}
+
+	if hc.Type == execHealthCheck && len(hc.Cmd) == 0 {
+		return nil, fmt.Errorf("Missing HealthCheck.Cmd (required for %s checks)", execHealthCheck)
+	}
+	if hc.Type != execHealthCheck && len(hc.Cmd) != 0 {
+		return nil, fmt.Errorf("HealthCheck.Cmd only applies to %s checks", execHealthCheck)
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"Timeout", def.Timeout, &hc.Timeout},
+		{"Interval", def.Interval, &hc.Interval},
+		{"StartupTimeout", def.StartupTimeout, &hc.StartupTimeout},
+	}
+	for _, d := range durations {
+		if len(d.value) == 0 {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid HealthCheck.%s: %s", d.name, err)
+		}
+		if duration <= 0 {
+			return nil, fmt.Errorf("HealthCheck.%s should be positive", d.name)
+		}
+		*d.dst = duration
+	}
+
+	return hc, nil
+}
+
+func (hc *HealthCheck) statusOk(status int) bool {
+	for _, code := range hc.StatusCodes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand returns a copy of the health check with vars substituted in its
+// path, command and header values.
+func (hc *HealthCheck) Expand(vars RunVars) *HealthCheck {
+	expanded := *hc
+	expanded.Path = vars.Expand(hc.Path)
+	expanded.Cmd = vars.Expand(hc.Cmd)
+	expanded.Headers = map[string]string{}
+	for name, value := range hc.Headers {
+		expanded.Headers[name] = vars.Expand(value)
+	}
+	return &expanded
+}
+
+// String describes what is checked, for logging.
+func (hc *HealthCheck) String() string {
+	switch hc.Type {
+	case tcpHealthCheck:
+		return "tcp"
+	case execHealthCheck:
+		return fmt.Sprintf("exec '%s'", hc.Cmd)
+	default:
+		return hc.Path
+	}
+}
+
+// Check performs a single health check against the app, which is running in
+// dir and on the given port. It returns the http status code (or -1 if no
+// response was received), and a non-nil error if the app is not healthy.
+func (hc *HealthCheck) Check(client *http.Client, dir string, port int) (int, error) {
+	switch hc.Type {
+	case tcpHealthCheck:
+		return hc.checkTcp(port)
+	case execHealthCheck:
+		return hc.checkExec(dir, port)
+	default:
+		return hc.checkHttp(client, port)
+	}
+}
+
+func (hc *HealthCheck) checkTcp(port int) (int, error) {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port), hc.Timeout)
+	if err != nil {
+		return -1, err
+	}
+	conn.Close()
+	return nonHttpHealthyStatus, nil
+}
+
+// shellCommand returns a command running cmdStr with sh, as cred unless
+// it's nil. When ctx is done its whole process group is killed, so
+// children holding the output pipe open don't keep us waiting.
+func shellCommand(ctx context.Context, cmdStr string, cred *syscall.Credential) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "sh", "-c", cmdStr)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: cred}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+	return cmd
+}
+
+func (hc *HealthCheck) checkExec(dir string, port int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, hc.Cmd, hc.Credential)
+	cmd.Dir = dir
+	cmd.Env = hc.Env
+	if cmd.Env == nil {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("PORT=%d", port))
+	}
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return -1, fmt.Errorf("Health check command timed out after %s", hc.Timeout)
+	}
+	if err != nil {
+		return -1, fmt.Errorf("Health check command failed (%s): %s",
+			err, strings.TrimSpace(string(output)))
+	}
+	return nonHttpHealthyStatus, nil
+}
+
+func (hc *HealthCheck) checkHttp(client *http.Client, port int) (int, error) {
+	url := fmt.Sprintf("http://localhost:%d%s", port, hc.Path)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return -1, err
+	}
+	for name, value := range hc.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	if !hc.statusOk(resp.StatusCode) {
+		return resp.StatusCode, fmt.Errorf("Health check got status %d, expected one of %v",
+			resp.StatusCode, hc.StatusCodes)
+	}
+
+	if len(hc.BodyContains) > 0 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return resp.StatusCode, err
+		}
+		if !strings.Contains(string(body), hc.BodyContains) {
+			return resp.StatusCode, fmt.Errorf("Health check response did not contain '%s'",
+				hc.BodyContains)
+		}
+	}
+
+	return resp.StatusCode, nil
+}
+
+func newHealthCheckClient() *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return errors.New("health check should not redirect")
+		},
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func testServerPort(t *testing.T, server *httptest.Server) int {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("parse url: %s", err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatalf("parse port: %s", err)
+	}
+	return port
+}
+
+func TestHealthCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		case "/host":
+			w.Write([]byte("host=" + r.Host))
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte("I'm ok!"))
+		}
+	}))
+	defer server.Close()
+	port := testServerPort(t, server)
+
+	tests := []struct {
+		def     HealthCheckDef
+		status  int
+		healthy bool
+	}{
+		{HealthCheckDef{Path: "/status"}, 200, true},
+		{HealthCheckDef{Path: "/broken"}, 500, false},
+		{HealthCheckDef{Path: "/empty"}, 204, false},
+		{HealthCheckDef{Path: "/empty", StatusCodes: []int{200, 204}}, 204, true},
+		{HealthCheckDef{Path: "/status", BodyContains: "ok"}, 200, true},
+		{HealthCheckDef{Path: "/status", BodyContains: "not ok"}, 200, false},
+		{HealthCheckDef{Path: "/host", BodyContains: "host=myapp.com",
+			Headers: map[string]string{"Host": "myapp.com"}}, 200, true},
+	}
+	for _, test := range tests {
+		hc, err := NewHealthCheck(test.def)
+		if err != nil {
+			t.Fatalf("%v: %s", test.def, err)
+		}
+		status, err := hc.Check(newHealthCheckClient(), "", port)
+		if status != test.status {
+			t.Errorf("%v: expected status %d, got %d", test.def, test.status, status)
+		}
+		if (err == nil) != test.healthy {
+			t.Errorf("%v: expected healthy=%t, got error %v", test.def, test.healthy, err)
+		}
+	}
+}
+
+func TestHealthCheckDefaults(t *testing.T) {
+	hc, err := NewHealthCheck(HealthCheckDef{})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if hc.Path != "/" || hc.StartupTimeout != MAX_STARTUP_TIME || !hc.statusOk(200) {
+		t.Errorf("unexpected defaults %v", hc)
+	}
+
+	if _, err := NewHealthCheck(HealthCheckDef{StartupTimeout: "soon"}); err == nil {
+		t.Errorf("expected error for invalid duration")
+	}
+}
+
+func TestNonHttpHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	tests := []struct {
+		def     HealthCheckDef
+		healthy bool
+	}{
+		{HealthCheckDef{Type: "tcp"}, true},
+		{HealthCheckDef{Type: "exec", Cmd: "true"}, true},
+		{HealthCheckDef{Type: "exec", Cmd: "test $PORT = " + strconv.Itoa(port)}, true},
+		{HealthCheckDef{Type: "exec", Cmd: "exit 3"}, false},
+		{HealthCheckDef{Type: "exec", Cmd: "sleep 5", Timeout: "100ms"}, false},
+	}
+	for _, test := range tests {
+		hc, err := NewHealthCheck(test.def)
+		if err != nil {
+			t.Fatalf("%v: %s", test.def, err)
+		}
+		if _, err := hc.Check(nil, "", port); (err == nil) != test.healthy {
+			t.Errorf("%v: expected healthy=%t, got error %v", test.def, test.healthy, err)
+		}
+	}
+
+	listener.Close()
+	hc, _ := NewHealthCheck(HealthCheckDef{Type: "tcp"})
+	if _, err := hc.Check(nil, "", port); err == nil {
+		t.Errorf("expected tcp check to fail once nothing is listening")
+	}
+
+	// given the app's environment, exec checks see its Env
+	hc, _ = NewHealthCheck(HealthCheckDef{Type: "exec", Cmd: `test "$DB_URL" = postgres://db`})
+	hc.Env = []string{"DB_URL=postgres://db"}
+	if _, err := hc.Check(nil, "", port); err != nil {
+		t.Errorf("expected exec check to get the app's Env, got %s", err)
+	}
+}
+
+func TestInvalidHealthCheck(t *testing.T) {
+	defs := []HealthCheckDef{
+		{Type: "udp"},
+		{Type: "exec"},
+		{Type: "tcp", Path: "/status"},
+		{Type: "http", Cmd: "true"},
+	}
+	for _, def := range defs {
+		if _, err := NewHealthCheck(def); err == nil {
+			t.Errorf("%v: expected error", def)
+		}
+	}
+}
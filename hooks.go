@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// A deploy can have commands run on the server around the changes made to
+// it (see HooksDef), e.g. to warm caches before it goes live, or to take it
+// out of a queue before it's stopped. They run in the deploy dir, as the
+// app's user with its environment, and their output goes to the deploy's
+// log. A pre hook that fails, or doesn't finish in time, vetoes the change;
+// a post hook failing is only logged, and noted in the audit log. Hooks
+// aren't run when the -enforce loop restarts a deploy, or when the server
+// shuts down.
+//
+// Other changes to the deploy are refused while its hooks run (see
+// ServerImpl.busy), so hooks mustn't make them themselves, e.g. by running
+// camus.
+
+const (
+	hookPreRun  = "pre-run"
+	hookPostRun = "post-run"
+	hookPreSet  = "pre-set"
+	hookPostSet = "post-set"
+	hookPreStop = "pre-stop"
+
+	defaultHookTimeout = 30 * time.Second
+
+	// How much of a failed hook's output is included in its error
+	maxHookErrorOutput = 500
+)
+
+type HooksDef struct {
+	// optional, shell commands run on the server before (Pre) or after
+	// (Post) the deploy is run, set live with 'camus set', or stopped.
+	// PORT is the deploy's port, and RunCmd's variables are substituted.
+	PreRun  string
+	PostRun string
+	PreSet  string
+	PostSet string
+	PreStop string
+
+	// optional, how long each hook has to finish, e.g. "1m" (default 30s)
+	Timeout string
+}
+
+type Hooks struct {
+	// hook name -> command
+	cmds    map[string]string
+	Timeout time.Duration
+}
+
+// NewHooks validates def, returning nil if there are no hooks.
+func NewHooks(def *HooksDef) (*Hooks, error) {
+	if def == nil {
+		return nil, nil
+	}
+	hooks := &Hooks{
+		cmds: map[string]string{
+			hookPreRun:  def.PreRun,
+			hookPostRun: def.PostRun,
+			hookPreSet:  def.PreSet,
+			hookPostSet: def.PostSet,
+			hookPreStop: def.PreStop,
+		},
+		Timeout: defaultHookTimeout,
+	}
+	if def.Timeout != "" {
+		timeout, err := time.ParseDuration(def.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Hooks.Timeout: %s", err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("Hooks.Timeout should be positive")
+		}
+		hooks.Timeout = timeout
+	}
+	return hooks, nil
+}
+
+// Cmd returns the command for the hook, "" if there isn't one.
+func (h *Hooks) Cmd(hook string) string {
+	if h == nil {
+		return ""
+	}
+	return h.cmds[hook]
+}
+
+// runHook runs the deploy's hook, if it has one, returning why it failed.
+// The caller has claimed the deploy, and doesn't hold s.lock.
+func (s *ServerImpl) runHook(app Application, hook string, deployId string, port int) error {
+	cmdStr := app.Hooks().Cmd(hook)
+	if cmdStr == "" {
+		return nil
+	}
+	vars := s.runVars(deployId, app, port)
+	cmdStr = vars.Expand(cmdStr)
+	timeout := app.Hooks().Timeout
+
+	// appended to without rotating it, which is left to the deploy's
+	// runner
+	output, err := openLog(s.logFile(deployId, ""))
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	fmt.Fprintf(output, "camus: running %s hook %s\n", hook, cmdStr)
+
+	// the pre-run hook runs before the deploy's runner would give the
+	// user the deploy dir
+	cred, err := s.deployCredential(app, vars.DeployDir)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := shellCommand(ctx, cmdStr, cred)
+	cmd.Dir = vars.DeployDir
+	cmd.Env = s.appEnv(app, vars)
+	var captured bytes.Buffer
+	cmd.Stdout = io.MultiWriter(output, &captured)
+	cmd.Stderr = cmd.Stdout
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%s hook timed out after %s", hook, timeout)
+	} else if err != nil {
+		out := strings.TrimSpace(captured.String())
+		if len(out) > maxHookErrorOutput {
+			out = "..." + out[len(out)-maxHookErrorOutput:]
+		}
+		err = fmt.Errorf("%s hook failed (%s): %s", hook, err, out)
+	}
+	if err != nil {
+		fmt.Fprintf(output, "camus: %s\n", err)
+	} else {
+		fmt.Fprintf(output, "camus: %s hook done\n", hook)
+	}
+	return err
+}
+
+// runPostHook runs the deploy's hook after a change has been made, when it
+// can only be reported if it fails.
+func (s *ServerImpl) runPostHook(app Application, hook string, deployId string, port int) {
+	if err := s.runHook(app, hook, deployId, port); err != nil {
+		log.Printf("%s: %s\n", deployId, err)
+		s.audit(Caller{}, auditHook, deployId, port, hook, err)
+	}
+}
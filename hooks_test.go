@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestInvalidHooks(t *testing.T) {
+	for _, timeout := range []string{"soon", "-1s"} {
+		if _, err := NewHooks(&HooksDef{Timeout: timeout}); err == nil ||
+			!strings.Contains(err.Error(), "Hooks.Timeout") {
+			t.Errorf("%s: expected an error about Hooks.Timeout, got %v", timeout, err)
+		}
+	}
+	if hooks, err := NewHooks(nil); err != nil || hooks.Cmd(hookPreRun) != "" {
+		t.Errorf("expected no hooks, got %v, %v", hooks, err)
+	}
+}
+
+func TestHooksAroundRunAndStop(t *testing.T) {
+	s := newTestServer(t)
+
+	deployId := "happy-paris-2026-01-01-00-00-00"
+	writeDeploy := func(hooks string) {
+		writeTestDeploy(t, s, deployId, `{
+			"RunCmd": "sleep 30 # %PORT%",
+			"HealthCheck": {"Type": "exec", "Cmd": "true"},
+			"Hooks": {`+hooks+`}
+		}`)
+	}
+
+	writeDeploy(`"PreRun": "echo not today; exit 3"`)
+	if _, err := s.Run(deployId); err == nil || !strings.Contains(err.Error(), "not today") {
+		t.Fatalf("expected the pre-run hook to veto running, got %v", err)
+	}
+	if s.lookupConfiguredPort(deployId) != 0 || s.runners[deployId] != nil {
+		t.Errorf("expected the deploy not to be configured or run")
+	}
+
+	writeDeploy(`"PreRun": "echo $PORT > pre-run", "PostRun": "touch post-run",
+		"PreStop": "test -f may-stop"`)
+	port, err := s.Run(deployId)
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	data, _ := ioutil.ReadFile(path.Join(s.deployDir(deployId), "pre-run"))
+	if strings.TrimSpace(string(data)) != strconv.Itoa(port) {
+		t.Errorf("expected the pre-run hook to get PORT %d, got %q", port, data)
+	}
+	if _, err := os.Stat(path.Join(s.deployDir(deployId), "post-run")); err != nil {
+		t.Errorf("expected the post-run hook to have run: %s", err)
+	}
+
+	if _, err := s.Stop(deployId, false); err == nil || !strings.Contains(err.Error(), "pre-stop") {
+		t.Errorf("expected the pre-stop hook to veto stopping, got %v", err)
+	}
+	if s.lookupConfiguredPort(deployId) != port {
+		t.Errorf("expected the deploy to still be configured")
+	}
+	if _, err := s.Stop(deployId, true); err != nil {
+		t.Errorf("expected -force to skip the pre-stop hook, got %s", err)
+	}
+
+	log, _ := ioutil.ReadFile(s.logFile(deployId, ""))
+	if !strings.Contains(string(log), "camus: running pre-run hook") {
+		t.Errorf("expected the hooks in the deploy's log, got %q", log)
+	}
+}
+
+func TestHooksTimeout(t *testing.T) {
+	s := newTestServer(t)
+
+	deployId := "happy-paris-2026-01-01-00-00-00"
+	writeTestDeploy(t, s, deployId, `{
+		"RunCmd": "sleep 30 # %PORT%",
+		"Hooks": {"PreSet": "sleep 10", "Timeout": "100ms"}
+	}`)
+	app, err := ApplicationFromConfig(false, s.deployConfigFile(deployId), "")
+	if err != nil {
+		t.Fatalf("read deploy.json: %s", err)
+	}
+	if err := s.runHook(app, hookPreSet, deployId, 9501); err == nil ||
+		!strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected the hook to time out, got %v", err)
+	}
+}
+
+func TestHooksRunAsAppUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to run hooks as another user")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("no nobody user: %s", err)
+	}
+	s := newTestServer(t)
+
+	deployId := "happy-paris-2026-01-01-00-00-00"
+	writeTestDeploy(t, s, deployId, `{
+		"RunCmd": "sleep 30 # %PORT%",
+		"HealthCheck": {"Type": "exec", "Cmd": "true"},
+		"User": "nobody",
+		"Hooks": {"PreRun": "touch pre-run"}
+	}`)
+	// so nobody can get to the deploy dir
+	os.Chmod(s.root, 0755)
+	os.Chmod(path.Dir(s.deployDir(deployId)), 0755)
+
+	// the pre-run hook is the first thing run as the user, so it has to be
+	// given the deploy dir
+	if _, err := s.Run(deployId); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	info, err := os.Stat(path.Join(s.deployDir(deployId), "pre-run"))
+	if err != nil {
+		t.Fatalf("expected the pre-run hook to write to the deploy dir: %s", err)
+	}
+	if uid := info.Sys().(*syscall.Stat_t).Uid; strconv.Itoa(int(uid)) != nobody.Uid {
+		t.Errorf("expected the hook to run as nobody (%s), got uid %d", nobody.Uid, uid)
+	}
+}
+
+func TestHooksSkippedForBrokenConfig(t *testing.T) {
+	s := newTestServer(t)
+	bin := path.Join(s.root, "bin")
+	os.Mkdir(bin, 0755)
+	ioutil.WriteFile(path.Join(bin, "haproxy"), []byte("#!/bin/sh\n"), 0755)
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	deployId := "happy-paris-2026-01-01-00-00-00"
+	writeTestDeploy(t, s, deployId, `{"RunCmd": `)
+	s.config.Ports[9501] = deployId
+
+	// it can still be rolled back to, just without its hooks
+	if err := s.SetActiveById(deployId); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if s.config.Active != deployId {
+		t.Errorf("expected %s to be active, got %q", deployId, s.config.Active)
+	}
+}
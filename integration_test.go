@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -55,7 +54,7 @@ func (tc *testClient) Run(deployId string) {
 }
 
 func (tc *testClient) Stop(deployId string) {
-	err := tc.client.Stop(deployId)
+	_, err := tc.client.Stop(deployId, false)
 	if err != nil {
 		tc.t.Fatalf("client stop: %s\n", err)
 	}
@@ -196,7 +195,7 @@ func startServer(
 		t.Fatal(err)
 	}
 
-	if err := json.Unmarshal(data, &def); err != nil {
+	if err := unmarshalConfig(data, &def); err != nil {
 		t.Fatalf("%s, Invalid json %s", confFile, err)
 	}
 
@@ -297,7 +296,7 @@ func TestPidRun(t *testing.T) {
 	var node *Deploy
 	var testappHaproxy *Deploy
 	for _, d := range deploys {
-		fmt.Printf(" - %s on %d @ %d - %s\n", d.Id, d.Port, d.Pid, d)
+		fmt.Printf(" - %s on %d @ %d - %v\n", d.Id, d.Port, d.Pid, d)
 		//deploy = frontend haproxy
 		if regexp.MustCompile("\\d\\d\\d\\d-\\d\\d-\\d\\d-\\d\\d-\\d\\d-\\d\\d").MatchString(d.Id) {
 			if testappHaproxy != nil {
@@ -336,13 +335,13 @@ func TestStop(t *testing.T) {
 	client.Build()
 	deployId := client.Push()
 
-	if err := client.client.Stop(deployId); err == nil {
+	if _, err := client.client.Stop(deployId, false); err == nil {
 		t.Fatalf("expected error when stopping non-running deploy")
 	}
 
 	client.Run(deployId)
 
-	if err := client.client.Stop("something made up"); err == nil {
+	if _, err := client.client.Stop("something made up", false); err == nil {
 		t.Fatalf("expected error when stopping non-existent deploy")
 	}
 
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Config files (deploy.json, config.json) may contain comments, written as
+// '//', '#' or '/* */', and trailing commas in objects and arrays. These are
+// blanked out before the data is handed to encoding/json, keeping every
+// other byte where it was so error offsets still point into the original.
+
+// unmarshalConfig is json.Unmarshal for the commented json dialect. Errors
+// are reported with the line and column they occurred at.
+func unmarshalConfig(data []byte, v interface{}) error {
+	stripped, err := stripJsonComments(data)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(stripped, v); err != nil {
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			// Offset is just past the offending character
+			return fmt.Errorf("%s: %s", jsonPosition(data, e.Offset-1), e)
+		case *json.UnmarshalTypeError:
+			return fmt.Errorf("%s: %s", jsonPosition(data, e.Offset), e)
+		}
+		return err
+	}
+	return nil
+}
+
+// stripJsonComments returns a copy of data with comments and trailing commas
+// replaced by spaces (newlines are kept).
+func stripJsonComments(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	copy(out, data)
+
+	inString := false
+	// index of a comma that hasn't yet been followed by a value
+	pendingComma := -1
+
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+			pendingComma = -1
+		case c == '#' || (c == '/' && i+1 < len(out) && out[i+1] == '/'):
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			end := bytes.Index(out[i+2:], []byte("*/"))
+			if end < 0 {
+				return nil, fmt.Errorf("%s: unterminated /* comment",
+					jsonPosition(data, int64(i)))
+			}
+			end += i + 4
+			for ; i < end; i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			i--
+		case c == ',':
+			pendingComma = i
+		case c == '}' || c == ']':
+			if pendingComma >= 0 {
+				out[pendingComma] = ' '
+			}
+			pendingComma = -1
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			pendingComma = -1
+		}
+	}
+
+	return out, nil
+}
+
+// jsonPosition describes a byte offset into data as a line and column.
+func jsonPosition(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	line, col := 1, 1
+	for _, c := range data[:offset] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Sprintf("line %d, column %d", line, col)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalCommentedConfig(t *testing.T) {
+	data := `{
+  # some name
+  "Name": "My#App", // not a comment: "//"
+  /* a block
+     comment */
+  "RunCmd": "node app.js %PORT% /* kept */",
+  "GroupTargets": {
+    "all": ["a", "b",],
+  },
+}`
+	var def ApplicationDef
+	if err := unmarshalConfig([]byte(data), &def); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	if def.Name != "My#App" {
+		t.Errorf("expected name My#App, got %s", def.Name)
+	}
+	if def.RunCmd != "node app.js %PORT% /* kept */" {
+		t.Errorf("comment markers in strings should be kept, got %s", def.RunCmd)
+	}
+	if len(def.GroupTargets["all"]) != 2 {
+		t.Errorf("expected 2 group members, got %v", def.GroupTargets["all"])
+	}
+}
+
+func TestUnmarshalConfigErrorPosition(t *testing.T) {
+	tests := []struct {
+		data     string
+		position string
+	}{
+		{"{\n  # comment\n  \"Name\": oops\n}", "line 3, column 11"},
+		{"{\n  \"Name\": 3\n}", "line 2"},
+		{"{\n  /* never closed\n}", "line 2, column 3"},
+	}
+	for _, test := range tests {
+		var def ApplicationDef
+		err := unmarshalConfig([]byte(test.data), &def)
+		if err == nil {
+			t.Errorf("expected error for %q", test.data)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), test.position) {
+			t.Errorf("expected error at %s, got %s", test.position, err)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// A deploy's processes can be given resource limits (see LimitsDef). Open
+// files are limited per process with setrlimit (by ulimit in the shell that
+// runs RunCmd). The rest are limits on the deploy as a whole, applied by
+// putting its processes in a cgroup of their own: camus-<deploy id> under
+// the server's cgroup. That needs a cgroup v2 hierarchy with the memory,
+// cpu and pids controllers available to the server, e.g. a systemd service
+// with Delegate=yes. Without one, MemoryMB falls back to a limit on each
+// process's address space, Processes to a per user rlimit, and the CPU
+// limits aren't applied; 'camus list' says so.
+
+const (
+	cgroupPrefix = "camus-"
+
+	// The leaf the server moves itself to, so that its cgroup can have
+	// controllers enabled for its children
+	cgroupServerLeaf = "camus-server"
+
+	// cpu.max's period, in microseconds
+	cgroupCpuPeriod = 100000
+)
+
+type LimitsDef struct {
+	// optional, most memory the deploy's processes may use together
+	MemoryMB int
+
+	// optional, the deploy's share of CPU time relative to other
+	// processes, 1 to 10000 (default 100)
+	CPUWeight int
+
+	// optional, most CPU time the deploy may use, in CPUs, e.g. 1.5
+	CPUs float64
+
+	// optional, most files each process may have open
+	OpenFiles int
+
+	// optional, most processes (and threads) the deploy may run
+	Processes int
+}
+
+type Limits struct {
+	MemoryMax int64
+	CPUWeight int
+	CPUs      float64
+	OpenFiles int
+	Processes int
+}
+
+// NewLimits validates def, returning nil if there are no limits.
+func NewLimits(def *LimitsDef) (*Limits, error) {
+	if def == nil {
+		return nil, nil
+	}
+	if def.MemoryMB < 0 {
+		return nil, fmt.Errorf("Limits.MemoryMB should be positive")
+	}
+	if def.CPUWeight < 0 || def.CPUWeight > 10000 {
+		return nil, fmt.Errorf("Limits.CPUWeight should be between 1 and 10000")
+	}
+	if def.CPUs < 0 {
+		return nil, fmt.Errorf("Limits.CPUs should be positive")
+	}
+	if def.OpenFiles < 0 {
+		return nil, fmt.Errorf("Limits.OpenFiles should be positive")
+	}
+	if def.Processes < 0 {
+		return nil, fmt.Errorf("Limits.Processes should be positive")
+	}
+	return &Limits{
+		MemoryMax: int64(def.MemoryMB) * 1024 * 1024,
+		CPUWeight: def.CPUWeight,
+		CPUs:      def.CPUs,
+		OpenFiles: def.OpenFiles,
+		Processes: def.Processes,
+	}, nil
+}
+
+// controllers returns the cgroup controllers needed to apply the limits.
+func (l *Limits) controllers() []string {
+	controllers := []string{}
+	if l.MemoryMax > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if l.CPUWeight > 0 || l.CPUs > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if l.Processes > 0 {
+		controllers = append(controllers, "pids")
+	}
+	return controllers
+}
+
+// rlimitScript returns shell commands applying the limits that are
+// rlimits, to be run before the command. inCgroup is whether the process
+// is in a cgroup applying the rest.
+func (l *Limits) rlimitScript(inCgroup bool) string {
+	script := ""
+	if l.OpenFiles > 0 {
+		script += fmt.Sprintf("ulimit -n %d || exit 1\n", l.OpenFiles)
+	}
+	if l.Processes > 0 && !inCgroup {
+		script += fmt.Sprintf("ulimit -u %d || exit 1\n", l.Processes)
+	}
+	if l.MemoryMax > 0 && !inCgroup {
+		// in KB. Address space is more than the memory used, but it's
+		// the closest rlimit still enforced.
+		script += fmt.Sprintf("ulimit -v %d || exit 1\n", l.MemoryMax/1024)
+	}
+	return script
+}
+
+// withoutCgroup describes how the limits that need a cgroup are applied
+// without one, if they are at all.
+func (l *Limits) withoutCgroup() []string {
+	fallbacks := []string{}
+	if l.MemoryMax > 0 {
+		fallbacks = append(fallbacks, "MemoryMB per process, as address space")
+	}
+	if l.CPUWeight > 0 {
+		fallbacks = append(fallbacks, "CPUWeight not applied")
+	}
+	if l.CPUs > 0 {
+		fallbacks = append(fallbacks, "CPUs not applied")
+	}
+	if l.Processes > 0 {
+		fallbacks = append(fallbacks, "Processes per user")
+	}
+	return fallbacks
+}
+
+// writeCgroup sets the limits on the cgroup dir, resetting those not given.
+func (l *Limits) writeCgroup(dir string) error {
+	files := map[string]string{
+		"memory.max": "max",
+		"cpu.weight": "100",
+		"cpu.max":    fmt.Sprintf("max %d", cgroupCpuPeriod),
+		"pids.max":   "max",
+	}
+	if l.MemoryMax > 0 {
+		files["memory.max"] = strconv.FormatInt(l.MemoryMax, 10)
+	}
+	if l.CPUWeight > 0 {
+		files["cpu.weight"] = strconv.Itoa(l.CPUWeight)
+	}
+	if l.CPUs > 0 {
+		files["cpu.max"] = fmt.Sprintf("%d %d",
+			int(l.CPUs*cgroupCpuPeriod), cgroupCpuPeriod)
+	}
+	if l.Processes > 0 {
+		files["pids.max"] = strconv.Itoa(l.Processes)
+	}
+	for name, value := range files {
+		file := path.Join(dir, name)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			// controller not enabled, so not needed
+			continue
+		}
+		if err := ioutil.WriteFile(file, []byte(value), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deployCgroup returns the cgroup dir for the deploy's processes, with the
+// limits applied, or "" if there are no limits needing one.
+func (s *ServerImpl) deployCgroup(deployId string, limits *Limits) (string, error) {
+	needed := limits.controllers()
+	if len(needed) == 0 {
+		return "", nil
+	}
+	s.cgroupOnce.Do(func() {
+		s.cgroupParent, s.cgroupErr = setupCgroupParent()
+	})
+	if s.cgroupErr != nil {
+		return "", s.cgroupErr
+	}
+	enabled, err := readCgroupList(path.Join(s.cgroupParent, "cgroup.subtree_control"))
+	if err != nil {
+		return "", err
+	}
+	for _, controller := range needed {
+		if !contains(enabled, controller) {
+			return "", fmt.Errorf("cgroup controller %s isn't available", controller)
+		}
+	}
+
+	dir := path.Join(s.cgroupParent, cgroupPrefix+deployId)
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if err := limits.writeCgroup(dir); err != nil {
+		return "", fmt.Errorf("cgroup %s: %s", dir, err)
+	}
+	return dir, nil
+}
+
+// applyLimits sets up r to run its process with the limits, noting in its
+// output and warnings any that can't be applied as given.
+func (s *ServerImpl) applyLimits(r *Runner, deployId string, limits *Limits) {
+	if limits == nil {
+		return
+	}
+	cgroup, err := s.deployCgroup(deployId, limits)
+	if err != nil {
+		warning := fmt.Sprintf("Can't apply limits with a cgroup (%s): %s", err,
+			strings.Join(limits.withoutCgroup(), ", "))
+		r.outputf("%s", warning)
+		r.Warnings = append(r.Warnings, warning)
+	}
+	r.Cgroup = cgroup
+	r.Setup = limits.rlimitScript(cgroup != "")
+}
+
+// setupCgroupParent finds the server's cgroup (v2) and enables the
+// controllers it can for its children, returning its dir.
+func setupCgroupParent() (string, error) {
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	mount := parseCgroup2Mount(string(mountinfo))
+	if mount == "" {
+		return "", fmt.Errorf("no cgroup v2 hierarchy")
+	}
+	own, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	dir := path.Join(mount, parseOwnCgroup(string(own)))
+
+	available, err := readCgroupList(path.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	controllers := []string{}
+	for _, controller := range []string{"memory", "cpu", "pids"} {
+		if contains(available, controller) {
+			controllers = append(controllers, "+"+controller)
+		}
+	}
+	if len(controllers) == 0 {
+		return "", fmt.Errorf("no cgroup controllers available in %s", dir)
+	}
+
+	enable := func() error {
+		return ioutil.WriteFile(path.Join(dir, "cgroup.subtree_control"),
+			[]byte(strings.Join(controllers, " ")), 0644)
+	}
+	err = enable()
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EBUSY && dir != mount {
+		// cgroups with processes in them can't have controllers enabled
+		// for their children, so move out of the way
+		leaf := path.Join(dir, cgroupServerLeaf)
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+		if err := ioutil.WriteFile(path.Join(leaf, "cgroup.procs"),
+			[]byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			return "", err
+		}
+		err = enable()
+	}
+	if err != nil {
+		return "", fmt.Errorf("enable cgroup controllers in %s: %s", dir, err)
+	}
+	return dir, nil
+}
+
+// parseCgroup2Mount returns where the cgroup v2 hierarchy is mounted, from
+// /proc/self/mountinfo, or "" if it isn't.
+func parseCgroup2Mount(mountinfo string) string {
+	scanner := bufio.NewScanner(strings.NewReader(mountinfo))
+	for scanner.Scan() {
+		// id parent major:minor root mount-point options ... - type source ...
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && len(fields) > 4 {
+				if fields[i+1] == "cgroup2" {
+					return fields[4]
+				}
+				break
+			}
+		}
+	}
+	return ""
+}
+
+// parseOwnCgroup returns the cgroup v2 path of the process, from
+// /proc/self/cgroup.
+func parseOwnCgroup(data string) string {
+	for _, line := range strings.Split(data, "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::")
+		}
+	}
+	return "/"
+}
+
+func readCgroupList(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidLimits(t *testing.T) {
+	defs := map[string]LimitsDef{
+		"MemoryMB":  {MemoryMB: -1},
+		"CPUWeight": {CPUWeight: 20000},
+		"CPUs":      {CPUs: -0.5},
+		"OpenFiles": {OpenFiles: -1},
+		"Processes": {Processes: -1},
+	}
+	for field, def := range defs {
+		def := def
+		_, err := NewLimits(&def)
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("expected an error about %s, got %v", field, err)
+		}
+	}
+}
+
+func TestLimitsCgroupFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camus-cgroup-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	// as if only the memory and cpu controllers were enabled
+	for _, name := range []string{"memory.max", "cpu.weight", "cpu.max"} {
+		ioutil.WriteFile(path.Join(dir, name), []byte("max\n"), 0644)
+	}
+
+	limits, _ := NewLimits(&LimitsDef{MemoryMB: 256, CPUs: 1.5})
+	if err := limits.writeCgroup(dir); err != nil {
+		t.Fatalf("write cgroup: %s", err)
+	}
+	expected := map[string]string{
+		"memory.max": "268435456",
+		"cpu.weight": "100",
+		"cpu.max":    "150000 100000",
+	}
+	for name, value := range expected {
+		if data, _ := ioutil.ReadFile(path.Join(dir, name)); string(data) != value {
+			t.Errorf("expected %s to be %q, got %q", name, value, data)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, "pids.max")); !os.IsNotExist(err) {
+		t.Errorf("expected files of controllers that aren't enabled to be left alone")
+	}
+}
+
+func TestParseCgroups(t *testing.T) {
+	mountinfo := "25 30 0:22 / /sys/fs/cgroup/memory rw,relatime shared:9 - cgroup cgroup rw,memory\n" +
+		"26 30 0:23 / /sys/fs/cgroup/unified rw,relatime shared:10 - cgroup2 cgroup2 rw\n"
+	if mount := parseCgroup2Mount(mountinfo); mount != "/sys/fs/cgroup/unified" {
+		t.Errorf("expected the cgroup2 mount, got %q", mount)
+	}
+	if own := parseOwnCgroup("4:memory:/a\n0::/system.slice/camus.service\n"); own != "/system.slice/camus.service" {
+		t.Errorf("expected the cgroup v2 path, got %q", own)
+	}
+}
+
+func TestLimitsWithoutCgroup(t *testing.T) {
+	limits, _ := NewLimits(&LimitsDef{MemoryMB: 512, CPUs: 1, Processes: 100})
+	script := limits.rlimitScript(false)
+	for _, expected := range []string{"ulimit -v 524288", "ulimit -u 100"} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("expected %q without a cgroup, got %q", expected, script)
+		}
+	}
+	if script := limits.rlimitScript(true); strings.Contains(script, "ulimit -v") {
+		t.Errorf("expected the cgroup to limit memory, got %q", script)
+	}
+
+	// reported for 'camus list' when there's no cgroup to be had
+	s := &ServerImpl{cgroupErr: errors.New("no cgroup v2 hierarchy")}
+	s.cgroupOnce.Do(func() {})
+	r := NewRunner(".", "true", nil, 0)
+	s.applyLimits(r, "happy-paris", limits)
+	if len(r.Warnings) != 1 || !strings.Contains(r.Warnings[0], "CPUs not applied") {
+		t.Errorf("expected a warning about the CPU limit, got %v", r.Warnings)
+	}
+}
+
+func TestRunnerAppliesRlimits(t *testing.T) {
+	f, err := ioutil.TempFile("", "camus-output-")
+	if err != nil {
+		t.Fatalf("create temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	limits, _ := NewLimits(&LimitsDef{OpenFiles: 64})
+	r := NewRunner(".", "ulimit -n; sleep 10", nil, 0)
+	r.Setup = limits.rlimitScript(false)
+	r.Output = f
+	go r.RunLoop()
+	defer r.Stop()
+	if err := r.WaitForStartup(); err != nil {
+		t.Fatalf("startup: %s", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		data, _ := ioutil.ReadFile(f.Name())
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == "64" {
+				return
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	data, _ := ioutil.ReadFile(f.Name())
+	t.Errorf("expected the process to have 64 open files at most, got %q", data)
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The stdout and stderr of each of a deploy's processes are written to
+// camus-logs/<name>.log in the deploy dir, where name is "app" for the main
+// RunCmd. When a log gets too big or too old it is rotated to <name>.log.1,
+// the previous .1 to .2 and so on, keeping at most LogPolicy.MaxFiles of
+// them.
+//
+// Processes write to their log file directly, rather than through a pipe to
+// the server, so that they can carry on if the server exits. As they hold
+// the file open, their logs are rotated by copying them to .1 and
+// truncating them (losing anything written in between), checked every
+// logsRotateInterval. A process left running by a previous server isn't
+// rotated until it's restarted.
+
+const (
+	logsDirName   = "camus-logs"
+	mainLogName   = "app"
+	logFileSuffix = ".log"
+
+	defaultLogMaxSizeMB = 10
+	defaultLogMaxFiles  = 5
+	defaultLogMaxAge    = 7 * 24 * time.Hour
+
+	// Most a single Logs call returns, follow mode picks up the rest.
+	maxLogsReplySize = 1024 * 1024
+
+	defaultLogLines = 50
+
+	// How often 'camus logs -f' asks for more
+	logsFollowInterval = time.Second
+
+	// How often logs being written by processes are checked for rotation
+	logsRotateInterval = 10 * time.Second
+)
+
+type LogsDef struct {
+	// optional, rotate once a log reaches this size (default 10)
+	MaxSizeMB int
+
+	// optional, number of rotated logs to keep (default 5)
+	MaxFiles int
+
+	// optional, rotate logs older than this, e.g. "24h" (default 7 days)
+	MaxAge string
+}
+
+type LogPolicy struct {
+	MaxSize  int64
+	MaxFiles int
+	MaxAge   time.Duration
+}
+
+func NewLogPolicy(def *LogsDef) (*LogPolicy, error) {
+	p := &LogPolicy{
+		MaxSize:  defaultLogMaxSizeMB * 1024 * 1024,
+		MaxFiles: defaultLogMaxFiles,
+		MaxAge:   defaultLogMaxAge,
+	}
+	if def == nil {
+		return p, nil
+	}
+	if def.MaxSizeMB < 0 {
+		return nil, fmt.Errorf("Logs.MaxSizeMB should be positive")
+	} else if def.MaxSizeMB > 0 {
+		p.MaxSize = int64(def.MaxSizeMB) * 1024 * 1024
+	}
+	if def.MaxFiles < 0 {
+		return nil, fmt.Errorf("Logs.MaxFiles should not be negative")
+	} else if def.MaxFiles > 0 {
+		p.MaxFiles = def.MaxFiles
+	}
+	if len(def.MaxAge) > 0 {
+		age, err := time.ParseDuration(def.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Logs.MaxAge: %s", err)
+		}
+		if age <= 0 {
+			return nil, fmt.Errorf("Logs.MaxAge should be positive")
+		}
+		p.MaxAge = age
+	}
+	return p, nil
+}
+
+// rotatingLog is an io.Writer appending to file, rotating it according to
+// policy.
+type rotatingLog struct {
+	file   string
+	policy *LogPolicy
+
+	lock   sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+
+	// closed by Close once f has been given out by File
+	unwatch chan int
+}
+
+func newRotatingLog(file string, policy *LogPolicy) *rotatingLog {
+	return &rotatingLog{file: file, policy: policy}
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+	if err := l.rotateIfNeeded(int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// File returns the log file for a process to write to directly, see
+// fileOutput.
+func (l *rotatingLog) File() (*os.File, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+	}
+	if l.unwatch == nil {
+		l.unwatch = make(chan int)
+		go l.watch(l.unwatch)
+	}
+	return l.f, nil
+}
+
+// watch rotates the log as need be while a process is writing to it.
+func (l *rotatingLog) watch(unwatch chan int) {
+	for {
+		select {
+		case <-unwatch:
+			return
+		case <-time.After(logsRotateInterval):
+		}
+		l.lock.Lock()
+		if l.f != nil {
+			if err := l.rotateIfNeeded(0); err != nil {
+				fmt.Fprintf(os.Stderr, "rotate %s: %s\n", l.file, err)
+			}
+		}
+		l.lock.Unlock()
+	}
+}
+
+func (l *rotatingLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.unwatch != nil {
+		close(l.unwatch)
+		l.unwatch = nil
+	}
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// openLog opens the log file for appending to, creating it if need be.
+func openLog(file string) (*os.File, error) {
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	// The deploy dir may belong to the app's user (see runAs), so don't
+	// follow links it could have put there
+	if info, err := os.Lstat(path.Dir(file)); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s isn't a directory", path.Dir(file))
+	}
+	return os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE|syscall.O_NOFOLLOW, 0644)
+}
+
+func (l *rotatingLog) open() error {
+	f, err := openLog(l.file)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = info.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+// rotateIfNeeded rotates the log if writing n more bytes to it would make
+// it too big, or it's too old.
+func (l *rotatingLog) rotateIfNeeded(n int64) error {
+	if l.unwatch != nil {
+		// a process is writing to it too
+		info, err := l.f.Stat()
+		if err != nil {
+			return err
+		}
+		l.size = info.Size()
+	}
+	if l.size == 0 || (l.size+n <= l.policy.MaxSize &&
+		time.Since(l.opened) <= l.policy.MaxAge) {
+		return nil
+	}
+	if l.unwatch != nil {
+		return l.copyTruncate()
+	}
+	return l.rotate()
+}
+
+func (l *rotatingLog) rotate() error {
+	l.f.Close()
+	l.f = nil
+	l.shiftRotated()
+	if err := os.Rename(l.file, rotatedLogFile(l.file, 1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// copyTruncate rotates the log without replacing the file, for when a
+// process has it open.
+func (l *rotatingLog) copyTruncate() error {
+	l.shiftRotated()
+	src, err := os.Open(l.file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(rotatedLogFile(l.file, 1),
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	l.size = 0
+	l.opened = time.Now()
+	return nil
+}
+
+// shiftRotated moves each rotated log up one, dropping the oldest.
+func (l *rotatingLog) shiftRotated() {
+	os.Remove(rotatedLogFile(l.file, l.policy.MaxFiles))
+	for i := l.policy.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(rotatedLogFile(l.file, i), rotatedLogFile(l.file, i+1))
+	}
+}
+
+func rotatedLogFile(file string, n int) string {
+	return fmt.Sprintf("%s.%d", file, n)
+}
+
+// logFile returns the log of the named process of the deploy, "" for the
+// main RunCmd.
+func (s *ServerImpl) logFile(deployId string, process string) string {
+	name := process
+	if name == "" {
+		name = mainLogName
+	}
+	return path.Join(s.deployDir(deployId), logsDirName, name+logFileSuffix)
+}
+
+// Logs returns the end of a deploy's log, or what has been written to it
+// since a previous reply (see LogsRequest).
+func (s *ServerImpl) Logs(req LogsRequest) (*LogsReply, error) {
+	if req.Process != "" {
+		app, err := ApplicationFromConfig(false, s.deployConfigFile(req.DeployId), "")
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, proc := range app.Processes() {
+			found = found || proc.Name == req.Process
+		}
+		if !found {
+			return nil, fmt.Errorf("Deploy %s has no process %s", req.DeployId, req.Process)
+		}
+	}
+
+	file := s.logFile(req.DeployId, req.Process)
+	if req.Follow {
+		return followLog(file, req.Inode, req.Offset, req.RotatedInode)
+	}
+	lines := req.Lines
+	if lines <= 0 {
+		lines = defaultLogLines
+	}
+	return tailLog(file, lines)
+}
+
+// tailLog returns the last lines lines of the log, reaching back into the
+// last rotated one if need be.
+func tailLog(file string, lines int) (*LogsReply, error) {
+	reply := &LogsReply{}
+	if inode, size, err := logFileInfo(file); err == nil {
+		reply.Inode, reply.Offset = inode, size
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	reply.RotatedInode, _, _ = logFileInfo(rotatedLogFile(file, 1))
+
+	data := []byte{}
+	for _, f := range []string{file, rotatedLogFile(file, 1)} {
+		remaining := lines - bytes.Count(data, []byte("\n"))
+		if remaining <= 0 {
+			break
+		}
+		tail, err := tailFile(f, remaining)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		data = append(tail, data...)
+	}
+	reply.Data = string(data)
+	return reply, nil
+}
+
+// tailFile returns at most the last lines lines of file, and no more than
+// maxLogsReplySize.
+func tailFile(file string, lines int) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	start := info.Size() - maxLogsReplySize
+	if start < 0 {
+		start = 0
+	}
+	data := make([]byte, info.Size()-start)
+	if _, err := f.ReadAt(data, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// the last line may not be finished yet
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if data[i] == '\n' {
+			lines--
+			if lines <= 0 {
+				return data[i+1:], nil
+			}
+		}
+	}
+	return data, nil
+}
+
+// followLog returns what has been written to the log since offset in the
+// file with inode, including the rest of it and any logs rotated after it
+// if it has since been rotated. rotatedInode is that of the last rotated log
+// at the time, a new one means the log has been rotated by copyTruncate.
+func followLog(file string, inode uint64, offset int64, rotatedInode uint64) (*LogsReply, error) {
+	reply := &LogsReply{}
+	curInode, size, err := logFileInfo(file)
+	if os.IsNotExist(err) {
+		reply.Inode, reply.Offset, reply.RotatedInode = inode, offset, rotatedInode
+		return reply, nil
+	} else if err != nil {
+		return nil, err
+	}
+	curRotatedInode, _, _ := logFileInfo(rotatedLogFile(file, 1))
+	reply.RotatedInode = curRotatedInode
+
+	data := []byte{}
+	if curInode != inode {
+		// it's been rotated, pick up where we were and read forwards
+		for n := 1; ; n++ {
+			rotatedInode, _, err := logFileInfo(rotatedLogFile(file, n))
+			if err != nil {
+				break
+			}
+			if rotatedInode != inode {
+				continue
+			}
+			for ; n >= 1; n-- {
+				rotated := rotatedLogFile(file, n)
+				more, err := readLogFrom(rotated, offset)
+				if err != nil {
+					return nil, err
+				}
+				data = append(data, more...)
+				if len(more) == maxLogsReplySize {
+					// more to come, carry on from here next time
+					reply.Inode, _, _ = logFileInfo(rotated)
+					reply.Offset = offset + int64(len(more))
+					reply.Data = string(data)
+					return reply, nil
+				}
+				offset = 0
+			}
+			break
+		}
+		offset = 0
+	} else if size < offset || curRotatedInode != rotatedInode {
+		// truncated by copyTruncate, so the rest is in the rotated log
+		if more, err := readLogFrom(rotatedLogFile(file, 1), offset); err == nil {
+			data = append(data, more...)
+		}
+		offset = 0
+	}
+
+	more, err := readLogFrom(file, offset)
+	if err != nil {
+		return nil, err
+	}
+	reply.Data = string(append(data, more...))
+	reply.Inode = curInode
+	reply.Offset = offset + int64(len(more))
+	return reply, nil
+}
+
+func readLogFrom(file string, offset int64) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(io.LimitReader(f, maxLogsReplySize))
+}
+
+func logFileInfo(file string) (inode uint64, size int64, err error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		inode = stat.Ino
+	}
+	return inode, info.Size(), nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camus-logs-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, logsDirName, "app.log")
+	l := newRotatingLog(file, &LogPolicy{MaxSize: 20, MaxFiles: 2, MaxAge: defaultLogMaxAge})
+	defer l.Close()
+
+	reply, err := tailLog(file, 10)
+	if err != nil || reply.Data != "" {
+		t.Fatalf("expected an empty log before anything is written, got %v, %v", reply, err)
+	}
+
+	// 10 bytes each, so every other line rotates
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(l, "line %04d\n", i)
+	}
+	follow, err := tailLog(file, 1)
+	if err != nil {
+		t.Fatalf("tail: %s", err)
+	}
+	if follow.Data != "line 0003\n" {
+		t.Errorf("expected the last line, got %q", follow.Data)
+	}
+
+	reply, err = tailLog(file, 3)
+	if err != nil {
+		t.Fatalf("tail: %s", err)
+	}
+	if reply.Data != "line 0001\nline 0002\nline 0003\n" {
+		t.Errorf("expected the last 3 lines across rotated logs, got %q", reply.Data)
+	}
+
+	for i := 4; i < 7; i++ {
+		fmt.Fprintf(l, "line %04d\n", i)
+	}
+	if _, err := os.Stat(rotatedLogFile(file, 3)); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated logs to be kept")
+	}
+
+	// picks up the rest of the rotated log, then the new one
+	reply, err = followLog(file, follow.Inode, follow.Offset, follow.RotatedInode)
+	if err != nil {
+		t.Fatalf("follow: %s", err)
+	}
+	if reply.Data != "line 0004\nline 0005\nline 0006\n" {
+		t.Errorf("expected the lines written since, got %q", reply.Data)
+	}
+
+	reply, err = followLog(file, reply.Inode, reply.Offset, reply.RotatedInode)
+	if err != nil || reply.Data != "" {
+		t.Errorf("expected nothing new, got %q, %v", reply.Data, err)
+	}
+}
+
+func TestTailUnfinishedLine(t *testing.T) {
+	f, err := ioutil.TempFile("", "camus-log-")
+	if err != nil {
+		t.Fatalf("create temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("one\ntwo\nthree")
+	f.Close()
+
+	data, err := tailFile(f.Name(), 2)
+	if err != nil {
+		t.Fatalf("tail: %s", err)
+	}
+	if string(data) != "two\nthree" {
+		t.Errorf("expected the last 2 lines, got %q", data)
+	}
+}
+
+func TestInvalidLogPolicy(t *testing.T) {
+	defs := map[string]LogsDef{
+		"MaxSizeMB": {MaxSizeMB: -1},
+		"MaxFiles":  {MaxFiles: -1},
+		"MaxAge":    {MaxAge: "a week"},
+	}
+	for field, def := range defs {
+		def := def
+		_, err := NewLogPolicy(&def)
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("expected an error about %s, got %v", field, err)
+		}
+	}
+
+	p, err := NewLogPolicy(nil)
+	if err != nil || p.MaxFiles != defaultLogMaxFiles {
+		t.Errorf("expected the default policy, got %v, %v", p, err)
+	}
+}
+
+func TestLogCopyTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camus-logs-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, logsDirName, "app.log")
+	l := newRotatingLog(file, &LogPolicy{MaxSize: 20, MaxFiles: 2, MaxAge: defaultLogMaxAge})
+	defer l.Close()
+
+	// as a process would
+	f, err := l.File()
+	if err != nil {
+		t.Fatalf("file: %s", err)
+	}
+	fmt.Fprintf(f, "line 0000\n")
+	follow, err := tailLog(file, 1)
+	if err != nil {
+		t.Fatalf("tail: %s", err)
+	}
+	fmt.Fprintf(f, "line 0001\nline 0002\n")
+
+	l.lock.Lock()
+	err = l.rotateIfNeeded(0)
+	l.lock.Unlock()
+	if err != nil {
+		t.Fatalf("rotate: %s", err)
+	}
+	fmt.Fprintf(f, "line 0003\n")
+
+	if data, _ := ioutil.ReadFile(file); string(data) != "line 0003\n" {
+		t.Errorf("expected the log to be truncated, got %q", data)
+	}
+	reply, err := followLog(file, follow.Inode, follow.Offset, follow.RotatedInode)
+	if err != nil {
+		t.Fatalf("follow: %s", err)
+	}
+	if reply.Data != "line 0001\nline 0002\nline 0003\n" {
+		t.Errorf("expected the lines written since, got %q", reply.Data)
+	}
+}
@@ -58,3 +58,13 @@ func TestLookupCwd(t *testing.T) {
 		}
 	}
 }
+
+func TestLookupUnexpectedOutput(t *testing.T) {
+	procs, err := parseLookupPortOutput("COMMAND PID\nnode 123\nnode abc x x x x x x x\n")
+	if err != nil || len(procs) != 0 {
+		t.Errorf("expected unexpected lines to be ignored, got %v, %v", procs, err)
+	}
+	if _, err := parseLookupCwdOutput("COMMAND PID USER FD TYPE NAME"); err == nil {
+		t.Errorf("expected an error for lsof output without a cwd")
+	}
+}
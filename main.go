@@ -13,6 +13,10 @@ import (
 
 // TODO the rest
 
+// The version of camus, recorded in the metadata of the deploys it pushes.
+// Set when building a release with -ldflags "-X main.version=...".
+var version = "dev"
+
 var serverRoot = flag.String("serverRoot", "", "Path to the root directory in the prod machine")
 var port = flag.Int("port", 8000, "port to serve on / connect to")
 var serverMode = flag.Bool("server", false, "If true, run as a server.")
@@ -58,11 +62,15 @@ func serverMain() {
 }
 
 func clientMain() {
-	client, err := NewClient(*deployFile, TargetName(*targetName), *isLocalTest)
-	if err != nil {
-		log.Fatal("NewClient:", err)
+	connect := func() (Client, error) {
+		client, err := NewClient(*deployFile, TargetName(*targetName), *isLocalTest)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
 	}
-	err = NewTerminalClient(flag.CommandLine, client).Run()
+	err := NewTerminalClient(
+		flag.CommandLine, *deployFile, TargetName(*targetName), *isLocalTest, connect).Run()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+)
+
+// When a build is pushed the client records where it came from in
+// camus-meta.json in the deploy dir, as a deploy id only says when it was
+// pushed. 'camus list' shows it.
+
+const deployMetaFileName = "camus-meta.json"
+
+// DeployMeta describes who pushed a deploy, and what code it contains.
+type DeployMeta struct {
+	// Who pushed it, and from which machine
+	User string
+	Host string
+
+	// The commit the app dir was at, "" if it isn't in a git repo. Dirty
+	// is true if it had uncommitted changes.
+	GitCommit string `json:",omitempty"`
+	GitBranch string `json:",omitempty"`
+	GitDirty  bool   `json:",omitempty"`
+
+	Pushed time.Time
+
+	// How long BuildCmd took, e.g. "12.5s"
+	BuildDuration string
+
+	// The version of camus that pushed it
+	CamusVersion string
+}
+
+// newDeployMeta describes a build of the app in appDir that took
+// buildDuration, being pushed now.
+func newDeployMeta(appDir string, buildDuration time.Duration) *DeployMeta {
+	meta := &DeployMeta{
+		User:          os.Getenv("USER"),
+		Pushed:        time.Now().UTC(),
+		BuildDuration: buildDuration.Round(time.Millisecond).String(),
+		CamusVersion:  version,
+	}
+	if u, err := user.Current(); err == nil {
+		meta.User = u.Username
+	}
+	meta.Host, _ = os.Hostname()
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = appDir
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	if commit, err := git("rev-parse", "HEAD"); err == nil {
+		meta.GitCommit = commit
+		meta.GitBranch, _ = git("rev-parse", "--abbrev-ref", "HEAD")
+		status, _ := git("status", "--porcelain")
+		meta.GitDirty = status != ""
+	}
+	return meta
+}
+
+// ShortCommit returns an abbreviated GitCommit, marked with a * if it was
+// dirty.
+func (m *DeployMeta) ShortCommit() string {
+	commit := m.GitCommit
+	if len(commit) > 8 {
+		commit = commit[:8]
+	}
+	if m.GitDirty {
+		commit += "*"
+	}
+	return commit
+}
+
+// PushedBy returns user@host.
+func (m *DeployMeta) PushedBy() string {
+	return m.User + "@" + m.Host
+}
+
+// String describes the deploy's origin on one line.
+func (m *DeployMeta) String() string {
+	desc := fmt.Sprintf("pushed %s by %s", m.Pushed.Format(time.RFC3339), m.PushedBy())
+	if m.GitCommit != "" {
+		desc += fmt.Sprintf(" from %s@%s", m.GitBranch, m.GitCommit)
+		if m.GitDirty {
+			desc += " (dirty)"
+		}
+	}
+	return desc + fmt.Sprintf(", built in %s, camus %s", m.BuildDuration, m.CamusVersion)
+}
+
+// deployMeta returns the deploy's metadata, nil for deploys pushed without
+// any.
+func (s *ServerImpl) deployMeta(deployId string) *DeployMeta {
+	data, err := ioutil.ReadFile(path.Join(s.deployDir(deployId), deployMetaFileName))
+	if err != nil {
+		return nil
+	}
+	meta := &DeployMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil
+	}
+	return meta
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeDeployMeta writes meta into the deploy dir, as pushing does.
+func writeDeployMeta(dir string, meta *DeployMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, deployMetaFileName), data, 0644)
+}
+
+func TestDeployMeta(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	appDir, err := ioutil.TempDir("", "camus-app-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(appDir)
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = appDir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+		return string(out)
+	}
+	git("init", "-q", "-b", "release")
+	ioutil.WriteFile(path.Join(appDir, "app.js"), []byte("1"), 0644)
+	git("add", "app.js")
+	git("-c", "user.name=test", "-c", "user.email=test@example.com",
+		"commit", "-q", "-m", "app")
+	commit := git("rev-parse", "HEAD")[:40]
+
+	meta := newDeployMeta(appDir, 1500*time.Millisecond)
+	if meta.GitCommit != commit || meta.GitBranch != "release" || meta.GitDirty {
+		t.Errorf("expected clean %s on release, got %+v", commit, meta)
+	}
+	if meta.BuildDuration != "1.5s" || meta.CamusVersion != version {
+		t.Errorf("unexpected build duration or version in %+v", meta)
+	}
+
+	ioutil.WriteFile(path.Join(appDir, "app.js"), []byte("2"), 0644)
+	meta = newDeployMeta(appDir, 0)
+	if !meta.GitDirty || meta.ShortCommit() != commit[:8]+"*" {
+		t.Errorf("expected a dirty %s, got %+v", commit[:8], meta)
+	}
+
+	// round trip through the deploy dir
+	deploysPath, err := ioutil.TempDir("", "camus-deploys-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(deploysPath)
+	s := &ServerImpl{deploysPath: deploysPath}
+	deployId := "happy-paris-2016-01-01-00-00-00"
+	os.Mkdir(s.deployDir(deployId), 0755)
+	if s.deployMeta(deployId) != nil {
+		t.Errorf("expected no metadata before it's written")
+	}
+	if err := writeDeployMeta(s.deployDir(deployId), meta); err != nil {
+		t.Fatalf("write meta: %s", err)
+	}
+	read := s.deployMeta(deployId)
+	if read == nil || read.String() != meta.String() {
+		t.Errorf("expected %s, got %v", meta, read)
+	}
+	if !s.deployCreated(deployId, read).Equal(meta.Pushed) {
+		t.Errorf("expected the deploy to be created when it was pushed")
+	}
+}
+
+func TestDeployMetaOutsideGit(t *testing.T) {
+	appDir, err := ioutil.TempDir("", "camus-app-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(appDir)
+
+	meta := newDeployMeta(appDir, time.Second)
+	if meta.GitCommit != "" || meta.GitBranch != "" || meta.GitDirty {
+		t.Errorf("expected no git details, got %+v", meta)
+	}
+	if meta.Host == "" {
+		t.Errorf("expected the host to be recorded")
+	}
+}
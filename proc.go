@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProcFinder finds listening processes by reading /proc directly (Linux
+// only): listening sockets come from /proc/net/tcp and tcp6, and their
+// owners from the socket links in each process's fd dir.
+type ProcFinder struct {
+	// Usually /proc
+	Root string
+}
+
+// tcpListen is the socket state of a listening socket in /proc/net/tcp.
+const tcpListen = "0A"
+
+func (f *ProcFinder) Listening(lowPort, highPort int) ([]Process, error) {
+	ports := map[string]int{}
+	for _, name := range []string{"tcp", "tcp6"} {
+		file := path.Join(f.Root, "net", name)
+		if err := parseProcNetTcp(file, lowPort, highPort, ports); err != nil {
+			if name == "tcp6" && os.IsNotExist(err) {
+				// no ipv6
+				continue
+			}
+			return nil, err
+		}
+	}
+	procs := []Process{}
+	if len(ports) == 0 {
+		return procs, nil
+	}
+
+	pids, err := procPids(f.Root)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[Process]bool{}
+	for _, pidStr := range pids {
+		pid, _ := strconv.Atoi(pidStr)
+		fdDir := path.Join(f.Root, pidStr, "fd")
+		// fails for other users' processes unless we're root, like lsof
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(path.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			port, ok := ports[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")]
+			if !ok {
+				continue
+			}
+			proc := Process{Port: port, Pid: pid}
+			if seen[proc] {
+				continue
+			}
+			seen[proc] = true
+			comm, _ := ioutil.ReadFile(path.Join(f.Root, pidStr, "comm"))
+			proc.Name = strings.TrimSpace(string(comm))
+			procs = append(procs, proc)
+		}
+	}
+	sort.Slice(procs, func(i, j int) bool {
+		if procs[i].Port != procs[j].Port {
+			return procs[i].Port < procs[j].Port
+		}
+		return procs[i].Pid < procs[j].Pid
+	})
+	return procs, nil
+}
+
+func (f *ProcFinder) Cwd(pid int) (string, error) {
+	cwd, err := os.Readlink(path.Join(f.Root, strconv.Itoa(pid), "cwd"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(cwd, " (deleted)"), nil
+}
+
+// parseProcNetTcp adds the inodes of the sockets listening on ports
+// between lowPort and highPort in file (/proc/net/tcp or tcp6) to ports,
+// mapped to their port.
+func parseProcNetTcp(file string, lowPort, highPort int, ports map[string]int) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			return fmt.Errorf("Unexpected line in %s: %s", file, scanner.Text())
+		}
+		if fields[3] != tcpListen {
+			continue
+		}
+		// address:port, both hex
+		local := fields[1]
+		port, err := strconv.ParseInt(local[strings.LastIndex(local, ":")+1:], 16, 32)
+		if err != nil {
+			return fmt.Errorf("Unexpected address in %s: %s", file, local)
+		}
+		if int(port) >= lowPort && int(port) <= highPort {
+			ports[fields[9]] = int(port)
+		}
+	}
+	return scanner.Err()
+}
+
+// procPids lists the ids of all processes in root (usually /proc).
+func procPids(root string) ([]string, error) {
+	f, err := os.Open(root)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	pids := []string{}
+	for _, name := range names {
+		if _, err := strconv.Atoi(name); err == nil {
+			pids = append(pids, name)
+		}
+	}
+	return pids, nil
+}
+
+// procState returns the state (e.g. "S", or "Z" for a zombie) and process
+// group of pid, from /proc/<pid>/stat.
+func procState(pid string) (string, int, error) {
+	fields, err := procStat(pid)
+	if err != nil {
+		return "", 0, err
+	}
+	pgid, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", 0, err
+	}
+	return fields[0], pgid, nil
+}
+
+// procStartTime returns when pid started, in clock ticks since boot. With
+// the pid it identifies a process, as pids are reused.
+func procStartTime(pid int) (uint64, error) {
+	fields, err := procStat(strconv.Itoa(pid))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// procSession returns the session of pid, from /proc/<pid>/stat.
+func procSession(pid int) (int, error) {
+	fields, err := procStat(strconv.Itoa(pid))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(fields[3])
+}
+
+// procCgroup returns the cgroup (v2) of pid, relative to the hierarchy's
+// root.
+func procCgroup(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	return parseOwnCgroup(string(data)), nil
+}
+
+// procAncestors returns the pids of pid's parent, its parent's parent and
+// so on, up to but not including init.
+func procAncestors(pid int) map[int]bool {
+	ancestors := map[int]bool{}
+	// bounded, in case of a loop as pids are reused while we look
+	for i := 0; i < 64; i++ {
+		fields, err := procStat(strconv.Itoa(pid))
+		if err != nil {
+			break
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil || ppid <= 1 || ancestors[ppid] {
+			break
+		}
+		ancestors[ppid] = true
+		pid = ppid
+	}
+	return ancestors
+}
+
+// procStat returns the fields of /proc/<pid>/stat after the command name,
+// i.e. starting with the state.
+func procStat(pid string) ([]string, error) {
+	data, err := ioutil.ReadFile("/proc/" + pid + "/stat")
+	if err != nil {
+		return nil, err
+	}
+	// pid (comm) state ppid pgrp ..., where comm may contain anything
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("Unexpected /proc/%s/stat: %s", pid, stat)
+	}
+	return fields, nil
+}
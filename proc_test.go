@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+var dummyProcNetTcp = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F41 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1111 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F42 0100007F:9C40 01 00000000:00000000 00:00000000 00000000  1000        0 2222 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 3333 1 0000000000000000 100 0 0 10 0
+`
+
+var dummyProcNetTcp6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:1F42 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 4444 1 0000000000000000 100 0 0 10 0
+`
+
+func TestProcFinder(t *testing.T) {
+	root, err := ioutil.TempDir("", "camus-proc-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(path.Join(root, "net"), 0755)
+	ioutil.WriteFile(path.Join(root, "net", "tcp"), []byte(dummyProcNetTcp), 0644)
+	ioutil.WriteFile(path.Join(root, "net", "tcp6"), []byte(dummyProcNetTcp6), 0644)
+	fakeProc := func(pid string, comm string, cwd string, sockets ...string) {
+		os.MkdirAll(path.Join(root, pid, "fd"), 0755)
+		ioutil.WriteFile(path.Join(root, pid, "comm"), []byte(comm+"\n"), 0644)
+		os.Symlink(cwd, path.Join(root, pid, "cwd"))
+		os.Symlink("/dev/null", path.Join(root, pid, "fd", "0"))
+		for i, socket := range sockets {
+			os.Symlink("socket:["+socket+"]", path.Join(root, pid, "fd", strconv.Itoa(3+i)))
+		}
+	}
+	fakeProc("100", "node", "/srv/deploys/happy-paris-2026-01-01-00-00-00", "1111")
+	fakeProc("200", "python3", "/srv/other", "2222", "4444")
+	fakeProc("300", "sshd", "/", "3333")
+
+	f := &ProcFinder{Root: root}
+	procs, err := f.Listening(8000, 8100)
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	expected := []Process{
+		{Port: 8001, Name: "node", Pid: 100},
+		{Port: 8002, Name: "python3", Pid: 200},
+	}
+	if len(procs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, procs)
+	}
+	for i := range expected {
+		if procs[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], procs[i])
+		}
+	}
+
+	cwd, err := f.Cwd(100)
+	if err != nil || deriveDeployIdFromCwd(cwd) != "happy-paris-2026-01-01-00-00-00" {
+		t.Errorf("expected the deploy's dir, got %q, %v", cwd, err)
+	}
+}
+
+func TestProcFinderFindsListener(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("no /proc")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	procs, err := (&ProcFinder{Root: "/proc"}).Listening(port, port)
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	if len(procs) != 1 || procs[0].Pid != os.Getpid() || procs[0].Port != port {
+		t.Errorf("expected this process listening on %d, got %v", port, procs)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Besides its main RunCmd, a deploy may run additional processes (see
+// ApplicationDef.Processes). They can't be found by the port they listen
+// on (they may not have one), so the server records each one it starts
+// (see ProcessRecord). Each is supervised by its own Runner, the records are
+// how they're found by a later server.
+
+// DeployProcess is the state of one of a deploy's additional processes.
+type DeployProcess struct {
+	Name string
+
+	// 0 if not running
+	Pid int
+
+	// 0 if the process doesn't have a port
+	Port int
+
+	// As for Deploy.Health. Processes without a health check report 0.
+	Health int
+
+	// As for Deploy.Status
+	Status string
+
+	Errors []string
+}
+
+// processPid returns the pid of the named process of the deploy, or 0 if it
+// isn't running.
+func (s *ServerImpl) processPid(deployId string, name string) int {
+	if r := s.liveRecord(runnerKey(deployId, name)); r != nil {
+		return r.Pid
+	}
+	return 0
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// allocateProcessPorts finds a free port for each of the app's processes
+// that needs one. The caller is responsible for writing the config.
+func (s *ServerImpl) allocateProcessPorts(deployId string, app Application) error {
+	ports := map[string]int{}
+	s.config.ProcessPorts[deployId] = ports
+	for _, proc := range app.Processes() {
+		if !proc.HasPort {
+			continue
+		}
+		port, err := s.findUnusedPort()
+		if err != nil {
+			delete(s.config.ProcessPorts, deployId)
+			return err
+		}
+		ports[proc.Name] = port
+	}
+	return nil
+}
+
+// startProcesses starts any of the deploy's processes that aren't already
+// running on the ports allocated to them, and waits for them to become
+// healthy.
+func (s *ServerImpl) startProcesses(deployId string, app Application, ports map[string]int) error {
+	for _, proc := range app.Processes() {
+		if s.processRunning(deployId, proc.Name) {
+			continue
+		}
+		if err := s.startProcess(deployId, app, proc, ports[proc.Name]); err != nil {
+			return fmt.Errorf("process %s: %s", proc.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *ServerImpl) startProcess(deployId string, app Application, proc *AppProcess, port int) error {
+	if proc.HasPort && port == 0 {
+		return fmt.Errorf("no port allocated")
+	}
+
+	vars := s.runVars(deployId, app, port)
+	r := NewRunner(vars.DeployDir, proc.RunCmd(vars), nil, port)
+	r.Env = s.appEnv(app, vars)
+	if proc.HealthCheck != nil {
+		r.Health = proc.HealthCheck.Expand(vars)
+		r.Health.Env = r.Env
+	}
+	r.Output = newRotatingLog(s.logFile(deployId, proc.Name), app.LogPolicy())
+	r.StopTimeout = app.StopTimeout()
+	s.applyLimits(r, deployId, app.Limits())
+	if err := s.runAs(r, app, vars); err != nil {
+		return err
+	}
+	r.OnStart = func(pid int) {
+		s.recordProcess(deployId, proc.Name, pid, port)
+	}
+	if err := s.supervise(runnerKey(deployId, proc.Name), r); err != nil {
+		return err
+	}
+	return r.WaitForStartup()
+}
+
+// processRunning is true if the named process of the deploy is supervised,
+// or was left running by a previous server.
+func (s *ServerImpl) processRunning(deployId string, name string) bool {
+	return s.runner(runnerKey(deployId, name)) != nil ||
+		s.processPid(deployId, name) != 0
+}
+
+// stopProcesses stops all of the deploy's processes that are running, in
+// parallel, giving each timeout to exit. It reports how each one ended.
+func (s *ServerImpl) stopProcesses(deployId string, timeout time.Duration) []*StopResult {
+	// those supervised or recorded
+	names := []string{}
+	prefix := runnerKey(deployId, "") + "/"
+	for _, key := range append(s.runnerKeys(prefix), s.recordedKeys(prefix)...) {
+		if name := strings.TrimPrefix(key, prefix); !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	results := make([]*StopResult, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			result := s.stopRunner(runnerKey(deployId, name))
+			if result == nil {
+				// not started by this server
+				if pid := s.processPid(deployId, name); pid != 0 {
+					result = stopProcessGroup(pid, timeout, nil)
+					s.forgetProcess(runnerKey(deployId, name), pid)
+				} else {
+					result = &StopResult{How: stopNotRunning}
+				}
+			}
+			result.Process = name
+			results[i] = result
+		}(i, name)
+	}
+	wg.Wait()
+	return results
+}
+
+func (s *ServerImpl) listProcesses(deployId string, app Application) []*DeployProcess {
+	procs := []*DeployProcess{}
+	for _, proc := range app.Processes() {
+		dp := &DeployProcess{
+			Name: proc.Name,
+			Pid:  s.processPid(deployId, proc.Name),
+			Port: s.config.ProcessPorts[deployId][proc.Name],
+		}
+		dp.Status, dp.Errors = s.runnerStatus(runnerKey(deployId, proc.Name))
+		procs = append(procs, dp)
+	}
+	return procs
+}
+
+func (s *ServerImpl) checkProcessHealth(deploy *Deploy, app Application) {
+	for _, proc := range app.Processes() {
+		var dp *DeployProcess
+		for _, p := range deploy.Processes {
+			if p.Name == proc.Name {
+				dp = p
+			}
+		}
+		if dp == nil || dp.Pid == 0 || proc.HealthCheck == nil {
+			continue
+		}
+		status, err := s.testApp(app, s.runVars(deploy.Id, app, dp.Port), proc.HealthCheck)
+		dp.Health = status
+		if err != nil {
+			dp.Errors = append(dp.Errors, fmt.Sprintf("%s", err))
+		}
+	}
+}
+
+// isProcessPort is true if port is configured for one of the additional
+// processes of a deploy (rather than a deploy's main RunCmd).
+func (s *ServerImpl) isProcessPort(port int) bool {
+	for _, ports := range s.config.ProcessPorts {
+		for _, p := range ports {
+			if p == port {
+				return true
+			}
+		}
+	}
+	return false
+}
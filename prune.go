@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deploys pile up in the deploys dir, so old ones are pruned according to a
+// RetentionPolicy, either on request or automatically by the enforce loop
+// (see Config.Retention). Deploys that are configured to run, running, the
+// active one or pinned are never pruned.
+
+type RetentionPolicy struct {
+	// Keep the newest Keep deploys
+	Keep int
+
+	// and/or those newer than this, e.g. "720h"
+	OlderThan string
+}
+
+// PruneDecision is whether a deploy is (or would be) pruned, and why.
+type PruneDecision struct {
+	Id      string
+	Created time.Time
+	Removed bool
+
+	// Why the deploy was kept
+	Reason string
+
+	// Why it couldn't be removed
+	Error string
+}
+
+func (p RetentionPolicy) String() string {
+	parts := []string{}
+	if p.Keep > 0 {
+		parts = append(parts, fmt.Sprintf("the newest %d", p.Keep))
+	}
+	if p.OlderThan != "" {
+		parts = append(parts, "those newer than "+p.OlderThan)
+	}
+	return "keep " + strings.Join(parts, " and ")
+}
+
+// maxAge validates the policy, returning OlderThan as a duration (0 if not
+// given).
+func (p RetentionPolicy) maxAge() (time.Duration, error) {
+	if p.Keep < 0 {
+		return 0, fmt.Errorf("Retention Keep should not be negative")
+	}
+	if p.OlderThan == "" {
+		if p.Keep == 0 {
+			return 0, fmt.Errorf("Retention needs Keep or OlderThan (or both)")
+		}
+		return 0, nil
+	}
+	age, err := time.ParseDuration(p.OlderThan)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid retention OlderThan: %s", err)
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("Retention OlderThan should be positive")
+	}
+	return age, nil
+}
+
+// deployCreated returns when the deploy was pushed, from its metadata (see
+// deployMeta) or the timestamp in its id (see NewDeployId), or failing
+// those its dir's modification time.
+func (s *ServerImpl) deployCreated(deployId string, meta *DeployMeta) time.Time {
+	if meta != nil && !meta.Pushed.IsZero() {
+		return meta.Pushed
+	}
+	parts := strings.Split(deployId, "-")
+	if len(parts) > 6 {
+		stamp := strings.Join(parts[len(parts)-6:], "-")
+		if t, err := time.Parse("2006-01-02-15-04-05", stamp); err == nil {
+			return t
+		}
+	}
+	if info, err := os.Stat(s.deployDir(deployId)); err == nil {
+		return info.ModTime().UTC()
+	}
+	return time.Time{}
+}
+
+// activeDeployId returns the deploy haproxy is pointing at, "" if none.
+func (s *ServerImpl) activeDeployId() (string, error) {
+	if s.config.Active != "" {
+		return s.config.Active, nil
+	}
+	port, err := getPortMarkedAsSet(s.endPort)
+	if err != nil {
+		if pid, _ := readPid(path.Join(s.root, haproxyPid)); pid > 0 {
+			return "", fmt.Errorf("Can't tell which deploy is active: %s", err)
+		}
+		// haproxy has never been started, so nothing is active
+		return "", nil
+	}
+	return s.config.Ports[port], nil
+}
+
+func (s *ServerImpl) isPinned(deployId string) bool {
+	return contains(s.config.Pinned, deployId)
+}
+
+// Pin protects a deploy from being pruned, or unpins it.
+func (s *ServerImpl) Pin(deployId string, pinned bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := os.Stat(s.deployDir(deployId)); err != nil {
+		return fmt.Errorf("No deploy %s", deployId)
+	}
+	if pinned == s.isPinned(deployId) {
+		return nil
+	}
+	if pinned {
+		s.config.Pinned = append(s.config.Pinned, deployId)
+		sort.Strings(s.config.Pinned)
+	} else {
+		kept := []string{}
+		for _, id := range s.config.Pinned {
+			if id != deployId {
+				kept = append(kept, id)
+			}
+		}
+		s.config.Pinned = kept
+	}
+	if err := s.writeConfig(); err != nil {
+		return fmt.Errorf("write config: %s", err)
+	}
+	return nil
+}
+
+// Prune removes the deploys the policy doesn't keep, or with dryRun just
+// says which it would. Decisions are returned newest first.
+func (s *ServerImpl) Prune(policy RetentionPolicy, dryRun bool) ([]*PruneDecision, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	maxAge, err := policy.maxAge()
+	if err != nil {
+		return nil, err
+	}
+	active, err := s.activeDeployId()
+	if err != nil {
+		return nil, err
+	}
+	procs := s.findListeningProcesses()
+	procsByDeployId := s.makeProcessDeployIdLookup(procs)
+
+	decisions := []*PruneDecision{}
+	for _, deployId := range s.readDeployIdsFromDisk() {
+		decisions = append(decisions, &PruneDecision{
+			Id:      deployId,
+			Created: s.deployCreated(deployId, s.deployMeta(deployId)),
+		})
+	}
+	sort.SliceStable(decisions, func(i, j int) bool {
+		return decisions[i].Created.After(decisions[j].Created)
+	})
+
+	now := time.Now()
+	for i, d := range decisions {
+		_, running := procsByDeployId[d.Id]
+		_, busy := s.busy[d.Id]
+		switch {
+		case s.lookupConfiguredPort(d.Id) != 0:
+			d.Reason = "configured"
+		case busy:
+			// e.g. running its pre-run hook
+			d.Reason = "being run"
+		case d.Id == active:
+			d.Reason = "active"
+		case s.isPinned(d.Id):
+			d.Reason = "pinned"
+		case running || s.supervised(d.Id) || s.anyProcessRunning(d.Id):
+			d.Reason = "running"
+		case i < policy.Keep:
+			d.Reason = fmt.Sprintf("one of the newest %d", policy.Keep)
+		case maxAge > 0 && now.Sub(d.Created) < maxAge:
+			d.Reason = "newer than " + policy.OlderThan
+		default:
+			d.Removed = true
+		}
+	}
+
+	if dryRun {
+		return decisions, nil
+	}
+	for _, d := range decisions {
+		if !d.Removed {
+			continue
+		}
+		if err := os.RemoveAll(s.deployDir(d.Id)); err != nil {
+			d.Removed = false
+			d.Error = fmt.Sprintf("%s", err)
+			continue
+		}
+		log.Printf("pruned %s\n", d.Id)
+	}
+	return decisions, nil
+}
+
+// anyProcessRunning is true if any of the deploy's processes are running,
+// going by the server's records.
+func (s *ServerImpl) anyProcessRunning(deployId string) bool {
+	if s.liveRecord(runnerKey(deployId, "")) != nil {
+		return true
+	}
+	for _, key := range s.recordedKeys(runnerKey(deployId, "") + "/") {
+		if s.liveRecord(key) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// enforceRetention prunes according to the configured retention policy,
+// if there is one.
+func (s *ServerImpl) enforceRetention() {
+	s.lock.RLock()
+	policy := s.config.Retention
+	s.lock.RUnlock()
+	if policy == nil {
+		return
+	}
+	decisions, err := s.Prune(*policy, false)
+	s.auditPrune(Caller{}, *policy, decisions, err)
+	if err != nil {
+		log.Printf("retention: %s\n", err)
+		return
+	}
+	for _, d := range decisions {
+		if d.Error != "" {
+			log.Printf("retention: failed to prune %s: %s\n", d.Id, d.Error)
+		}
+	}
+}
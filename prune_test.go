@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidRetentionPolicy(t *testing.T) {
+	policies := map[string]RetentionPolicy{
+		"negative": {Keep: -1},
+		"needs":    {},
+		"Invalid":  {OlderThan: "a month"},
+		"positive": {OlderThan: "-1h"},
+	}
+	for msg, p := range policies {
+		if _, err := p.maxAge(); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected an error containing %q for %v, got %v", msg, p, err)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	s := newTestServer(t)
+
+	now := time.Now().UTC()
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		created := now.Add(-time.Duration(i) * 24 * time.Hour)
+		id := "happy-paris-" + created.Format("2006-01-02-15-04-05")
+		os.MkdirAll(s.deployDir(id), 0755)
+		ids = append(ids, id)
+	}
+	s.config.Ports[9501] = ids[4]
+	if err := s.Pin(ids[3], true); err != nil {
+		t.Fatalf("pin: %s", err)
+	}
+
+	decisions, err := s.Prune(RetentionPolicy{Keep: 1, OlderThan: "36h"}, true)
+	if err != nil {
+		t.Fatalf("prune: %s", err)
+	}
+	expected := []string{"one of the newest 1", "newer than 36h", "", "pinned", "configured"}
+	for i, d := range decisions {
+		if d.Id != ids[i] || d.Reason != expected[i] || d.Removed != (expected[i] == "") {
+			t.Errorf("expected %s kept for %q, got %+v", ids[i], expected[i], d)
+		}
+	}
+	if _, err := os.Stat(s.deployDir(ids[2])); err != nil {
+		t.Errorf("expected a dry run not to remove anything: %s", err)
+	}
+
+	if _, err := s.Prune(RetentionPolicy{Keep: 1, OlderThan: "36h"}, false); err != nil {
+		t.Fatalf("prune: %s", err)
+	}
+	if _, err := os.Stat(s.deployDir(ids[2])); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", ids[2])
+	}
+	if len(s.readDeployIdsFromDisk()) != 4 {
+		t.Errorf("expected the other deploys to be kept")
+	}
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"strings"
+	"time"
+)
+
 type RpcServer struct {
 	server *ServerImpl
 }
@@ -23,47 +28,57 @@ func (s *RpcServer) ListDeploys(arg ListDeploysRequest, reply *ListDeploysReply)
 ////////////////
 
 type SetActivePortRequest struct {
-	Port int
+	Port   int
+	Caller Caller
 }
 type SetActivePortReply struct {
 }
 
 func (s *RpcServer) SetActiveByPort(arg SetActivePortRequest,
 	reply *SetActivePortReply) error {
-	return s.server.SetActiveByPort(arg.Port)
+	deployId := s.server.deployOnPort(arg.Port)
+	err := s.server.SetActiveByPort(arg.Port)
+	s.server.audit(arg.Caller, auditSet, deployId, arg.Port, "", err)
+	return err
 }
 
 ////////////////
 
 type SetActiveByIdRequest struct {
-	Id string
+	Id     string
+	Caller Caller
 }
 type SetActiveByIdReply struct{}
 
 func (s *RpcServer) SetActiveById(arg SetActiveByIdRequest,
 	reply *SetActiveByIdReply) error {
-	return s.server.SetActiveById(arg.Id)
+	err := s.server.SetActiveById(arg.Id)
+	s.server.audit(arg.Caller, auditSet, arg.Id, 0, "", err)
+	return err
 }
 
 ////////////////
 
 type RunRequest struct {
 	DeployId string
+	Caller   Caller
 }
 type RunReply struct {
 	Port int
 }
 
 func (s *RpcServer) Run(arg RunRequest, reply *RunReply) error {
-	deployId, err := s.server.GetFullDeployIdFromShortName(arg.DeployId)
+	deployId, err := s.resolveDeployId(arg.Caller, auditRun, arg.DeployId)
 	if err != nil {
 		return err
 	}
 
 	port, err := s.server.Run(deployId)
 	if err != nil {
+		s.server.audit(arg.Caller, auditRun, deployId, 0, "", err)
 		return err
 	}
+	s.server.audit(arg.Caller, auditRun, deployId, port, "", nil)
 
 	reply.Port = port
 	return nil
@@ -101,41 +116,201 @@ func (s *RpcServer) GetDeploysPath(arg GetDeploysPathRequest, reply *GetDeploysP
 
 type StopDeployRequest struct {
 	DeployId string
+	Caller   Caller
+
+	// Skip the deploy's pre-stop hook
+	Force bool
 }
 type StopDeployResponse struct {
+	// How the deploy's processes ended, the main RunCmd first
+	Results []*StopResult
 }
 
 func (s *RpcServer) StopDeploy(arg StopDeployRequest, reply *StopDeployResponse) error {
-	deployId, err := s.server.GetFullDeployIdFromShortName(arg.DeployId)
+	deployId, err := s.resolveDeployId(arg.Caller, auditStop, arg.DeployId)
+	if err != nil {
+		return err
+	}
+
+	results, err := s.server.Stop(deployId, arg.Force)
+	s.server.audit(arg.Caller, auditStop, deployId, 0, "", err)
+	if err != nil {
+		return err
+	}
+	reply.Results = results
+	return nil
+}
+
+////////////////
+
+type LogsRequest struct {
+	DeployId string
+
+	// "" for the main RunCmd, or the name of one of the deploy's Processes
+	Process string
+
+	// How many lines to return from the end of the log (default 50)
+	Lines int
+
+	// Return what was written after a previous reply's Inode, Offset and
+	// RotatedInode instead, to follow the log
+	Follow       bool
+	Inode        uint64
+	Offset       int64
+	RotatedInode uint64
+
+	Caller Caller
+}
+type LogsReply struct {
+	Data string
+
+	// Where the log is up to, for following it
+	Inode        uint64
+	Offset       int64
+	RotatedInode uint64
+}
+
+func (s *RpcServer) Logs(arg LogsRequest, reply *LogsReply) error {
+	deployId, err := s.resolveDeployId(arg.Caller, auditLogs, arg.DeployId)
 	if err != nil {
 		return err
 	}
+	arg.DeployId = deployId
 
-	return s.server.Stop(deployId)
+	logs, err := s.server.Logs(arg)
+	if err != nil {
+		return err
+	}
+	*reply = *logs
+	return nil
+}
+
+////////////////
+
+type PruneRequest struct {
+	Policy RetentionPolicy
+
+	// Only say what would be removed
+	DryRun bool
+
+	Caller Caller
+}
+type PruneReply struct {
+	Decisions []*PruneDecision
+}
+
+func (s *RpcServer) Prune(arg PruneRequest, reply *PruneReply) error {
+	decisions, err := s.server.Prune(arg.Policy, arg.DryRun)
+	if !arg.DryRun {
+		s.server.auditPrune(arg.Caller, arg.Policy, decisions, err)
+	}
+	if err != nil {
+		return err
+	}
+	reply.Decisions = decisions
+	return nil
+}
+
+////////////////
+
+type PinRequest struct {
+	DeployId string
+
+	// false to unpin
+	Pinned bool
+
+	Caller Caller
+}
+type PinReply struct{}
+
+func (s *RpcServer) Pin(arg PinRequest, reply *PinReply) error {
+	action := auditPin
+	if !arg.Pinned {
+		action = auditUnpin
+	}
+	deployId, err := s.resolveDeployId(arg.Caller, action, arg.DeployId)
+	if err != nil {
+		return err
+	}
+
+	err = s.server.Pin(deployId, arg.Pinned)
+	s.server.audit(arg.Caller, action, deployId, 0, "", err)
+	return err
 }
 
 ////////////////
 
 type KillUnknownProcessesRequest struct {
+	Caller Caller
 }
 
 type KillUnknownProcessesResponse struct {
+	Results []*StopResult
 }
 
 func (s *RpcServer) KillUnknownProcesses(arg KillUnknownProcessesRequest, reply *KillUnknownProcessesResponse) error {
-	s.server.KillUnknownProcesses()
+	reply.Results = s.server.KillUnknownProcesses()
+	killed := []string{}
+	for _, result := range reply.Results {
+		killed = append(killed, result.String())
+	}
+	s.server.audit(arg.Caller, auditKillUnknown, "", 0, strings.Join(killed, "; "), nil)
 	return nil
 }
 
 ////////////////
 
 type ShutdownRequest struct {
+	Caller Caller
 }
 
 type ShutdownResponse struct {
 }
 
 func (s *RpcServer) Shutdown(arg ShutdownRequest, reply *ShutdownResponse) error {
+	// before, as the server exits
+	s.server.audit(arg.Caller, auditShutdown, "", 0, "", nil)
 	s.server.Shutdown()
 	return nil
 }
+
+////////////////
+
+type HistoryRequest struct {
+	// Only entries from since until until (zero for no limit)
+	Since time.Time
+	Until time.Time
+
+	// Only entries about this deploy, "" for all
+	DeployId string
+}
+type HistoryReply struct {
+	Entries []*AuditEntry
+}
+
+func (s *RpcServer) History(arg HistoryRequest, reply *HistoryReply) error {
+	deployId := arg.DeployId
+	if deployId != "" {
+		// deploys that have since been pruned are still in the history
+		if fullId, err := s.server.GetFullDeployIdFromShortName(deployId); err == nil {
+			deployId = fullId
+		}
+	}
+	entries, err := s.server.History(arg.Since, arg.Until, deployId)
+	if err != nil {
+		return err
+	}
+	reply.Entries = entries
+	return nil
+}
+
+// resolveDeployId returns the full id of the deploy named by shortName,
+// auditing the caller's action as failed, under shortName, if there isn't
+// one.
+func (s *RpcServer) resolveDeployId(caller Caller, action string, shortName string) (string, error) {
+	deployId, err := s.server.GetFullDeployIdFromShortName(shortName)
+	if err != nil {
+		s.server.audit(caller, action, shortName, 0, "", err)
+	}
+	return deployId, err
+}
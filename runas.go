@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Deploys can be run as another user and group (see Config.User and
+// ApplicationDef.User), so that app code doesn't get the server's rights.
+// Their processes and exec health checks are started with those
+// credentials, and the deploy dir is given to the user. The server has to
+// run as root to do this.
+//
+// The server's config decides: anyone who can push a deploy can write its
+// deploy.json, so it only gets to choose its user when the server's config
+// doesn't, and can't choose root unless the config allows it.
+
+// credential returns who to run the app's processes as, nil for the
+// server's own user.
+func (s *ServerImpl) credential(app Application) (*syscall.Credential, error) {
+	userName, groupName := s.config.User, s.config.Group
+	fromApp := userName == ""
+	if fromApp {
+		userName, groupName = app.User(), app.Group()
+	}
+	if userName == "" && groupName == "" {
+		return nil, nil
+	} else if userName == "" {
+		// or it would run as the server's user, root
+		return nil, fmt.Errorf("Group %s needs a User", groupName)
+	}
+	cred, err := lookupCredential(userName, groupName)
+	if err != nil {
+		return nil, err
+	}
+	if !fromApp && (app.User() != "" || app.Group() != "") {
+		asked, err := lookupCredential(app.User(), app.Group())
+		if err != nil {
+			return nil, err
+		}
+		if app.User() != "" && asked.Uid != cred.Uid || app.Group() != "" && asked.Gid != cred.Gid {
+			return nil, fmt.Errorf("This server runs deploys as %s, not %s",
+				userName+":"+groupName, app.User()+":"+app.Group())
+		}
+	}
+	if fromApp && cred.Uid == 0 && !s.config.AllowRoot {
+		return nil, fmt.Errorf("This server doesn't allow deploys to run as root (see AllowRoot)")
+	}
+	if os.Geteuid() != 0 {
+		if cred.Uid == uint32(os.Getuid()) && cred.Gid == uint32(os.Getgid()) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("The server has to run as root to run deploys as %s", userName+":"+groupName)
+	}
+	return cred, nil
+}
+
+// deployCredential is credential, but first gives the app's user the
+// deploy dir, so anything run as them there can write to it.
+func (s *ServerImpl) deployCredential(app Application, deployDir string) (*syscall.Credential, error) {
+	cred, err := s.credential(app)
+	if err != nil || cred == nil {
+		return cred, err
+	}
+	if err := chownDeploy(deployDir, cred); err != nil {
+		return nil, fmt.Errorf("Can't give the deploy dir to uid %d: %s", cred.Uid, err)
+	}
+	return cred, nil
+}
+
+// runAs sets up r to run the app's process, and its health check, as the
+// app's user, giving the user the deploy dir.
+func (s *ServerImpl) runAs(r *Runner, app Application, vars RunVars) error {
+	cred, err := s.deployCredential(app, vars.DeployDir)
+	if err != nil || cred == nil {
+		return err
+	}
+	r.Credential = cred
+	if r.Health != nil {
+		r.Health.Credential = cred
+	}
+	return nil
+}
+
+// lookupCredential returns the credentials of the user (a name or uid) and
+// group (a name or gid). The group defaults to the user's, and the user to
+// ours.
+func lookupCredential(userName, groupName string) (*syscall.Credential, error) {
+	cred := &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+	if userName != "" {
+		u, err := lookupUser(userName)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		gid, _ := strconv.Atoi(u.Gid)
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+		if groupIds, err := u.GroupIds(); err == nil {
+			for _, id := range groupIds {
+				if gid, err := strconv.Atoi(id); err == nil {
+					cred.Groups = append(cred.Groups, uint32(gid))
+				}
+			}
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, isId := strconv.Atoi(groupName); err != nil && isId == nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unknown group %s", groupName)
+		}
+		gid, _ := strconv.Atoi(g.Gid)
+		cred.Gid = uint32(gid)
+	}
+	return cred, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if _, isId := strconv.Atoi(name); err != nil && isId == nil {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unknown user %s", name)
+	}
+	return u, nil
+}
+
+// chownDeploy gives the deploy dir to the user and group, unless it already
+// belongs to them. The logs dir is left to the server.
+func chownDeploy(dir string, cred *syscall.Credential) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok &&
+		stat.Uid == cred.Uid && stat.Gid == cred.Gid {
+		return nil
+	}
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == logsDirName {
+			return filepath.SkipDir
+		}
+		return os.Lchown(file, int(cred.Uid), int(cred.Gid))
+	})
+}
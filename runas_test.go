@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestLookupCredential(t *testing.T) {
+	me, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %s", err)
+	}
+	uid, _ := strconv.Atoi(me.Uid)
+	gid, _ := strconv.Atoi(me.Gid)
+
+	for _, name := range []string{me.Username, me.Uid} {
+		cred, err := lookupCredential(name, "")
+		if err != nil {
+			t.Fatalf("lookup %s: %s", name, err)
+		}
+		if cred.Uid != uint32(uid) || cred.Gid != uint32(gid) {
+			t.Errorf("%s: expected %d:%d, got %d:%d", name, uid, gid, cred.Uid, cred.Gid)
+		}
+	}
+
+	cred, err := lookupCredential("", me.Gid)
+	if err != nil {
+		t.Fatalf("lookup group %s: %s", me.Gid, err)
+	}
+	if cred.Uid != uint32(os.Getuid()) || cred.Gid != uint32(gid) {
+		t.Errorf("expected our uid and gid %d, got %d:%d", gid, cred.Uid, cred.Gid)
+	}
+
+	if _, err := lookupCredential("no-such-camus-user", ""); err == nil {
+		t.Errorf("expected an error for an unknown user")
+	}
+	if _, err := lookupCredential("", "no-such-camus-group"); err == nil {
+		t.Errorf("expected an error for an unknown group")
+	}
+}
+
+func TestChownOwnedDeploy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camus-deploy-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(path.Join(dir, logsDirName), 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+
+	// already ours, so there's nothing to change even when not root
+	cred := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if err := chownDeploy(dir, cred); err != nil {
+		t.Errorf("chown deploy: %s", err)
+	}
+}
+
+func TestRunAsServerConfigDecides(t *testing.T) {
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skipf("no nobody user: %s", err)
+	}
+	app := func(config string) Application {
+		app, err := applicationFromData(false, []byte(`{"RunCmd": "node app.js %PORT%"`+config+`}`))
+		if err != nil {
+			t.Fatalf("load %s: %s", config, err)
+		}
+		return app
+	}
+
+	s := &ServerImpl{config: Config{User: "nobody"}}
+	if _, err := s.credential(app(`, "User": "root"`)); err == nil ||
+		!strings.Contains(err.Error(), "runs deploys as nobody") {
+		t.Errorf("expected the server's User to win, got %v", err)
+	}
+	if _, err := s.credential(app(`, "User": "nobody"`)); err != nil &&
+		strings.Contains(err.Error(), "runs deploys as") {
+		t.Errorf("expected the server's own User to be allowed, got %s", err)
+	}
+
+	s = &ServerImpl{}
+	if _, err := s.credential(app(`, "User": "0"`)); err == nil ||
+		!strings.Contains(err.Error(), "AllowRoot") {
+		t.Errorf("expected root to be refused, got %v", err)
+	}
+	s.config.AllowRoot = true
+	if _, err := s.credential(app(`, "User": "0"`)); err != nil &&
+		strings.Contains(err.Error(), "AllowRoot") {
+		t.Errorf("expected root to be allowed, got %s", err)
+	}
+
+	if _, err := applicationFromData(false, []byte(
+		`{"RunCmd": "node app.js %PORT%", "Group": "nogroup"}`)); err == nil {
+		t.Errorf("expected a Group without a User to be refused")
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -38,50 +41,102 @@ func (s Status) String() string {
 }
 
 const (
-	healthWaitDuration time.Duration = 1 * time.Second
+	// How long to wait before restarting a process that has exited, doubled
+	// for each consecutive failure (see restartBackoff).
+	restartDelay time.Duration = 1 * time.Second
 
-	maxRunnerRetries int = 5
+	// Only the most recent logs are kept.
+	maxRunnerLogs int = 100
 )
 
 type Runner struct {
-	Dir        string
-	Cmd        string
-	HealthPath string
-	Port       int
-	stop       chan int
-	Pid        int32
+	Dir  string
+	Cmd  string
+	Port int
+	Pid  int32
+
+	// nil if the process is healthy as soon as it has started
+	Health *HealthCheck
+
+	// optional, the environment of the process (defaults to ours)
+	Env []string
+
+	// optional, shell commands run before Cmd in the same shell, e.g. ulimit
+	Setup string
+
+	// optional, who the process runs as (defaults to us)
+	Credential *syscall.Credential
+
+	// optional, the cgroup (v2) dir to start the process in. Removed, if
+	// nothing else is in it, when RunLoop returns.
+	Cgroup string
+
+	// optional, problems with how the process is run that don't stop it
+	// running, e.g. limits that couldn't be applied. Listed with its errors.
+	Warnings []string
+
+	// optional, where the process's stdout and stderr go. Closed, if it's
+	// an io.Closer, when RunLoop returns. If it's a fileOutput the process
+	// is given the file itself.
+	Output io.Writer
+
+	// optional, called with the pid of the process each time it starts
+	OnStart func(pid int)
+
+	// How long the process has to exit after SIGTERM when it's stopped,
+	// before it's killed (0 for defaultStopTimeout)
+	StopTimeout time.Duration
+
+	client *http.Client
+
+	// stop is closed by Stop, done is closed when RunLoop returns, and
+	// started receives the outcome of the first startup.
+	stop     chan int
+	stopOnce sync.Once
+	done     chan int
+	started  chan error
 
 	// cond is a condition variable on status changing, with lock as its
-	// lockable. lock guards both status and logs.
-	cond   *sync.Cond
-	lock   *sync.Mutex
-	status Status
-	logs   []string
+	// lockable. lock guards status, err, stopped, logs and backoff.
+	cond    *sync.Cond
+	lock    *sync.Mutex
+	status  Status
+	err     error
+	stopped *StopResult
+	logs    []string
+	backoff restartBackoff
 }
 
-func NewRunner(dir, cmd, healthPath string, port int) *Runner {
+var errRunnerStopped = errors.New("stopped")
+
+func NewRunner(dir, cmd string, health *HealthCheck, port int) *Runner {
 	lock := &sync.Mutex{}
 	return &Runner{
-		Dir:        dir,
-		Cmd:        cmd,
-		HealthPath: healthPath,
-		Port:       port,
-		stop:       make(chan int),
-		lock:       lock,
-		cond:       sync.NewCond(lock),
+		Dir:     dir,
+		Cmd:     cmd,
+		Health:  health,
+		Port:    port,
+		client:  newHealthCheckClient(),
+		stop:    make(chan int),
+		done:    make(chan int),
+		started: make(chan error, 1),
+		lock:    lock,
+		cond:    sync.NewCond(lock),
 	}
 }
 
 func (r *Runner) checkHealth() bool {
-	url := fmt.Sprintf("http://localhost:%d%s", r.Port, r.HealthPath)
-	r.logf("Getting %s\n", url)
-	resp, err := http.Get(url)
+	if r.Health == nil {
+		return true
+	}
+	r.logf("Checking %s on port %d\n", r.Health, r.Port)
+	status, err := r.Health.Check(r.client, r.Dir, r.Port)
 	if err != nil {
-		r.logf("Failed to get: %s\n", err)
+		r.logf("Unhealthy: %s\n", err)
 		return false
 	}
-	r.logf("Status code: %v\n", resp.StatusCode)
-	return resp.StatusCode == http.StatusOK
+	r.logf("Status code: %v\n", status)
+	return true
 }
 
 func (r *Runner) setStatus(status Status) {
@@ -98,6 +153,21 @@ func (r *Runner) Status() Status {
 	return r.status
 }
 
+// setError puts the runner in the Error status because of err.
+func (r *Runner) setError(err error) {
+	r.lock.Lock()
+	r.err = err
+	r.lock.Unlock()
+	r.setStatus(Error)
+}
+
+// Err returns why the runner last went into the Error status.
+func (r *Runner) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
 func (r *Runner) logf(format string, args ...interface{}) {
 	r.log(fmt.Sprintf(format, args...))
 }
@@ -114,16 +184,47 @@ func (r *Runner) log(msg string) {
 
 func (r *Runner) logNolock(msg string) {
 	r.logs = append(r.logs, msg)
+	if len(r.logs) > maxRunnerLogs {
+		r.logs = r.logs[len(r.logs)-maxRunnerLogs:]
+	}
+}
+
+// outputf notes what happened to the process in its output, so it can be
+// read in context.
+func (r *Runner) outputf(format string, args ...interface{}) {
+	if r.Output != nil {
+		fmt.Fprintf(r.Output, "camus: "+format+"\n", args...)
+	}
 }
 
 func (r *Runner) Logs() []string {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	return r.logs
+	return append([]string{}, r.logs...)
 }
 
-func (r *Runner) Stop() {
-	r.stop <- 0
+// Stop stops the process and waits for RunLoop to return, reporting how
+// the process ended. It is safe to call more than once.
+func (r *Runner) Stop() *StopResult {
+	r.stopOnce.Do(func() { close(r.stop) })
+	<-r.done
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped == nil {
+		// it wasn't running at the time
+		return &StopResult{How: stopNotRunning}
+	}
+	return r.stopped
+}
+
+func (r *Runner) stopping() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
 }
 
 func (r *Runner) WaitForStatusChange() Status {
@@ -133,68 +234,231 @@ func (r *Runner) WaitForStatusChange() Status {
 	return r.status
 }
 
+// WaitForStartup waits for the process to first become healthy, returning
+// an error if it didn't.
+func (r *Runner) WaitForStartup() error {
+	err := <-r.started
+	// leave it there for anyone else waiting
+	r.startupDone(err)
+	return err
+}
+
+func (r *Runner) startupDone(err error) {
+	select {
+	case r.started <- err:
+	default:
+	}
+}
+
 func (r *Runner) run() bool {
-	cmd := exec.Command("sh", "-c", r.Cmd)
+	if r.stopping() {
+		return false
+	}
+
+	cmd := exec.Command("sh", "-c", r.Setup+r.Cmd)
 	cmd.Dir = r.Dir
+	cmd.Env = r.Env
+	cmd.Stdout = r.Output
+	if out, ok := r.Output.(fileOutput); ok {
+		if f, err := out.File(); err == nil {
+			cmd.Stdout = f
+		} else {
+			r.logf("output: %s, piping it instead\n", err)
+		}
+	}
+	cmd.Stderr = cmd.Stdout
+	// don't wait on output held open by anything it left running
+	cmd.WaitDelay = time.Second
+	detachProc(cmd)
+	cmd.SysProcAttr.Credential = r.Credential
+	if r.Cgroup != "" {
+		fd, err := syscall.Open(r.Cgroup, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+		if err != nil {
+			r.setError(err)
+			r.startupDone(err)
+			return false
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = fd
+	}
 	r.logf("running %s\n", cmd.Args)
 	err := cmd.Start()
+	if cmd.SysProcAttr.UseCgroupFD {
+		syscall.Close(cmd.SysProcAttr.CgroupFD)
+	}
 	if err != nil {
-		r.logf("Failed to start\n")
-		r.setStatus(Error)
+		r.logf("Failed to start: %s\n", err)
+		r.setError(err)
+		r.startupDone(err)
 		return false
 	}
 	r.setStatus(Starting)
-	atomic.StoreInt32(&r.Pid, int32(cmd.Process.Pid))
-	// TODO(koz): Separate the health checking into a separate goroutine /
-	// state variable.
+	startedAt := time.Now()
+	pid := cmd.Process.Pid
+	r.outputf("started %s (pid %d)", r.Cmd, pid)
+	atomic.StoreInt32(&r.Pid, int32(pid))
+	if r.OnStart != nil {
+		r.OnStart(pid)
+	}
+
+	exited := make(chan *os.ProcessState, 1)
+	go func() {
+		cmd.Wait()
+		exited <- cmd.ProcessState
+	}()
+
+	// Check health until the process is healthy, exits, or runs out of
+	// time to start.
+	var exitState *os.ProcessState
 	healthOk := false
-	for i := 0; i < maxRunnerRetries; i++ {
+	var end time.Time
+	var interval time.Duration
+	if r.Health != nil {
+		end = time.Now().Add(r.Health.StartupTimeout)
+		interval = r.Health.Interval
+	}
+	for exitState == nil {
 		r.logf("Checking health...\n")
 		if r.checkHealth() {
 			healthOk = true
-			r.logf("Health is good!\n")
 			break
 		}
-		time.Sleep(healthWaitDuration)
+		if time.Now().After(end) {
+			break
+		}
+		select {
+		case exitState = <-exited:
+		case <-r.stop:
+			return r.kill(pid, exited)
+		case <-time.After(interval):
+		}
+	}
+
+	if exitState != nil {
+		// Exiting at startup = unrecoverable error, like not becoming healthy
+		r.logf("process exited with status %v\n", exitState)
+		r.outputf("exited while starting (%v)", exitState)
+		syscall.Kill(-pid, syscall.SIGKILL)
+		return r.startupFailed(fmt.Errorf("process exited while starting (%v)", exitState))
+	}
+	if !healthOk {
+		// Health check failed at startup = unrecoverable error. Don't leave
+		// it running, holding its port.
+		result := stopProcessGroup(pid, r.stopTimeout(), exited)
+		r.outputf("not healthy after %s, stopped: %s", r.Health.StartupTimeout, result.summary())
+		return r.startupFailed(fmt.Errorf("App not healthy after %s", r.Health.StartupTimeout))
 	}
-	if healthOk {
-		r.setStatus(Running)
+
+	r.logf("Health is good!\n")
+	r.setStatus(Running)
+	r.startupDone(nil)
+	select {
+	case exitState = <-exited:
+	case <-r.stop:
+		return r.kill(pid, exited)
+	}
+	failure := fmt.Errorf("process exited (%v)", exitState)
+
+	r.logf("process exited with status %v\n", exitState)
+	r.outputf("exited (%v)", exitState)
+	// clean up anything it left behind in its group before restarting
+	syscall.Kill(-pid, syscall.SIGKILL)
+
+	r.lock.Lock()
+	if time.Since(startedAt) >= stableRunTime {
+		r.backoff.reset()
+	}
+	delay := r.backoff.failed(failure)
+	crashLooping := r.backoff.crashLooping()
+	r.lock.Unlock()
+	if crashLooping {
+		r.outputf("crash looping, restarting in %s", delay)
 	} else {
-		// Health check failed at startup = unrecoverable error.
-		r.setStatus(Error)
+		r.outputf("restarting in %s", delay)
 	}
-	exitChan := make(chan int)
-	pid := cmd.Process.Pid
-	go func() {
-		exitState, _ := cmd.Process.Wait()
-		r.logf("process exited with status %v\n", exitState)
-		r.setStatus(Stopped)
-		exitChan <- 0
-	}()
+	r.setStatus(Stopped)
+	return true
+}
 
-	shouldLoop := true
-	for {
-		select {
-		case <-exitChan:
-			r.logf("Exiting, shouldLoop = %t\n", shouldLoop)
-			// Process has exited.
-			return shouldLoop
-		case <-r.stop:
-			r.logf("Killing process at callers request...\n")
-			shouldLoop = false
-			// We don't use cmd.Process.Kill() here as Process is used in the
-			// goroutine that's Wait()ing on the process to terminate.
-			if p, err := os.FindProcess(pid); err == nil {
-				p.Kill()
-			}
-		}
+// startupFailed puts the runner in the Error status because the process
+// didn't start up, which isn't retried.
+func (r *Runner) startupFailed(err error) bool {
+	r.logf("%s\n", err)
+	r.setError(err)
+	r.startupDone(err)
+	return false
+}
+
+// restartWait returns how long to wait before restarting the process after
+// it has exited.
+func (r *Runner) restartWait() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return time.Until(r.backoff.next)
+}
+
+// CrashLoop describes the process's failures if it keeps failing, else
+// returns "".
+func (r *Runner) CrashLoop() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.backoff.crashLooping() {
+		return ""
+	}
+	return r.backoff.String()
+}
+
+// kill stops the process group at the callers request, first with SIGTERM
+// and then SIGKILL if it doesn't exit within StopTimeout.
+func (r *Runner) kill(pid int, exited chan *os.ProcessState) bool {
+	r.logf("Stopping process at callers request...\n")
+	r.startupDone(errRunnerStopped)
+	r.outputf("stopping, sending SIGTERM")
+	result := stopProcessGroup(pid, r.stopTimeout(), exited)
+	r.logf("stopped: %s\n", result.summary())
+	r.outputf("stopped: %s", result.summary())
+
+	r.lock.Lock()
+	r.stopped = result
+	r.lock.Unlock()
+	r.setStatus(Stopped)
+	return false
+}
+
+func (r *Runner) stopTimeout() time.Duration {
+	if r.StopTimeout == 0 {
+		return defaultStopTimeout
 	}
+	return r.StopTimeout
+}
+
+// fileOutput is a Runner.Output the process can write to directly, rather
+// than through a pipe to the server, so that it can carry on after the
+// server exits.
+type fileOutput interface {
+	File() (*os.File, error)
 }
 
+// RunLoop runs the process, restarting it whenever it exits, until Stop is
+// called. It returns the number of restarts.
 func (r *Runner) RunLoop() int {
+	defer close(r.done)
+	defer r.startupDone(errRunnerStopped)
+	if closer, ok := r.Output.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if r.Cgroup != "" {
+		// fails if another of the deploy's processes is still in it
+		defer os.Remove(r.Cgroup)
+	}
+
 	retries := 0
 	for r.run() {
 		retries++
+		select {
+		case <-r.stop:
+		case <-time.After(r.restartWait()):
+		}
 	}
 	return retries
 }
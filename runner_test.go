@@ -1,30 +1,53 @@
 package main
 
 import (
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
+// How long waitForStatus waits before failing the test
+const waitForStatusTimeout = 30 * time.Second
+
 func waitForStatus(t *testing.T, r *Runner, status Status) {
-	for {
-		s := r.WaitForStatusChange()
-		if s == status {
-			if r.Status() != s {
-				t.Fatalf("expected status of %v but was %v", s, r.Status())
+	reached := make(chan Status, 1)
+	go func() {
+		for {
+			s := r.WaitForStatusChange()
+			// If we aren't specifically waiting for Error and we reach it,
+			// then we'll never get to any other status.
+			if s == status || s == Error {
+				reached <- s
+				return
 			}
-			return
 		}
-		// If we aren't specifically waiting for Error and we reach it, then
-		// we'll never get to any other status.
-		if s == Error {
-			t.Fatalf("process reached error state while waiting for %v\n", status)
+	}()
+	select {
+	case s := <-reached:
+		if s != status {
+			t.Fatalf("process reached error state while waiting for %v: %v\n", status, r.Err())
+		}
+		if r.Status() != s {
+			t.Fatalf("expected status of %v but was %v", s, r.Status())
 		}
+	case <-time.After(waitForStatusTimeout):
+		t.Fatalf("still %v after %s waiting for %v", r.Status(), waitForStatusTimeout, status)
+	}
+}
+
+func testHealthCheck(t *testing.T) *HealthCheck {
+	hc, err := NewHealthCheck(HealthCheckDef{Path: "/status"})
+	if err != nil {
+		t.Fatalf("health check: %s", err)
 	}
+	return hc
 }
 
 func TestRunner(t *testing.T) {
-	r := NewRunner("testapp", "node app.js 8001", "/status", 8001)
+	r := NewRunner("testapp", "node app.js 8001", testHealthCheck(t), 8001)
 	done := make(chan int)
 	go func() {
 		done <- r.RunLoop()
@@ -61,7 +84,7 @@ func killAndWaitForStopped(t *testing.T, r *Runner) {
 }
 
 func TestRunnerRestartsCrash(t *testing.T) {
-	r := NewRunner("testapp", "node app.js 8001", "/status", 8001)
+	r := NewRunner("testapp", "node app.js 8001", testHealthCheck(t), 8001)
 	done := make(chan int)
 	go func() {
 		done <- r.RunLoop()
@@ -79,3 +102,89 @@ func TestRunnerRestartsCrash(t *testing.T) {
 		t.Fatalf("expected status to be Stopped after RunLoop() returns, but was %v", status)
 	}
 }
+
+func TestRunnerWithoutHealthCheck(t *testing.T) {
+	started := make(chan int, 1)
+	r := NewRunner(os.TempDir(), "sleep 30", nil, 0)
+	r.OnStart = func(pid int) { started <- pid }
+	go r.RunLoop()
+	if err := r.WaitForStartup(); err != nil {
+		t.Fatalf("expected startup to succeed, got %s", err)
+	}
+	if pid := <-started; pid != int(r.Pid) {
+		t.Fatalf("OnStart got pid %d, expected %d", pid, r.Pid)
+	}
+	if status := r.Status(); status != Running {
+		t.Fatalf("expected Running, was %v", status)
+	}
+	r.Stop()
+	if status := r.Status(); status != Stopped {
+		t.Fatalf("expected Stopped after Stop(), was %v", status)
+	}
+	if processAlive(int(r.Pid)) {
+		t.Fatalf("process %d still alive after Stop()", r.Pid)
+	}
+	// stopping again is harmless
+	r.Stop()
+}
+
+func TestRunnerNoticesExitWhileStarting(t *testing.T) {
+	hc, err := NewHealthCheck(HealthCheckDef{Type: "tcp", StartupTimeout: "30s"})
+	if err != nil {
+		t.Fatalf("health check: %s", err)
+	}
+	// nothing listens on a port we've just closed
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	r := NewRunner(os.TempDir(), "exit 3", hc, port)
+	done := make(chan int)
+	go func() {
+		done <- r.RunLoop()
+	}()
+	defer r.Stop()
+
+	start := time.Now()
+	if err := r.WaitForStartup(); err == nil {
+		t.Fatalf("expected startup to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("took %s to notice the process exited", elapsed)
+	}
+	// and isn't restarted
+	if retries := <-done; retries != 0 {
+		t.Errorf("expected no retries, got %d", retries)
+	}
+	if r.Status() != Error || r.Err() == nil {
+		t.Errorf("expected Error, got %v (%v)", r.Status(), r.Err())
+	}
+}
+
+func TestRunnerStopsUnhealthyStartup(t *testing.T) {
+	hc, err := NewHealthCheck(HealthCheckDef{Type: "exec", Cmd: "false",
+		StartupTimeout: "200ms", Interval: "50ms"})
+	if err != nil {
+		t.Fatalf("health check: %s", err)
+	}
+	r := NewRunner(os.TempDir(), "sleep 30", hc, 0)
+	r.StopTimeout = time.Second
+	done := make(chan int)
+	go func() {
+		done <- r.RunLoop()
+	}()
+
+	if err := r.WaitForStartup(); err == nil || !strings.Contains(err.Error(), "not healthy") {
+		t.Fatalf("expected startup to fail, got %v", err)
+	}
+	<-done
+	if r.Status() != Error {
+		t.Errorf("expected Error, got %v", r.Status())
+	}
+	if processAlive(int(r.Pid)) {
+		t.Errorf("expected process %d to have been stopped", r.Pid)
+	}
+}
@@ -12,8 +12,10 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -33,7 +35,7 @@ type Deploy struct {
 	// The id of the process running this deploy.
 	Pid int
 
-	// Is this the port that is currently 'set' and haProxy is 
+	// Is this the port that is currently 'set' and haProxy is
 	// pointing to it
 	Set bool
 
@@ -44,6 +46,28 @@ type Deploy struct {
 	// if 0, and port is specified, then it's safe to run the binary
 	Health int
 
+	// Names of the environment variables exported to the deploy
+	// (values are deliberately not exposed)
+	EnvKeys []string
+
+	// The deploy's additional processes (see ApplicationDef.Processes)
+	Processes []*DeployProcess
+
+	// Never pruned, see ServerImpl.Pin
+	Pinned bool
+
+	// Status of the server's supervisor for the deploy (Starting, Running,
+	// Stopped or Error), "" if it isn't supervised by this server
+	Status string
+
+	// Where the deploy came from, nil if it was pushed without metadata
+	Meta *DeployMeta
+
+	// When it was pushed, see deployCreated, and to which target ("" if
+	// not recorded)
+	Created time.Time
+	Target  TargetName
+
 	Errors []string
 }
 
@@ -66,35 +90,124 @@ const (
 	haproxyConfig        = "haproxy.cfg"
 	haproxyPid           = "haproxy.pid"
 	appPid               = "PID_FILE"
+	deployTargetFileName = "camus-target"
+	serverLockFileName   = "camus.lock"
 	minShortNameLength   = 3
 )
 
 type Config struct {
 	Ports map[int]string
+
+	// Ports of the additional processes of configured deploys,
+	// deploy id -> process name -> port
+	ProcessPorts map[string]map[string]int
+
+	// The deploy haproxy was last pointed at with 'camus set', restored
+	// when the server starts
+	Active string
+
+	// Deploys that are never pruned
+	Pinned []string
+
+	// optional, pruning done by the enforce loop
+	Retention *RetentionPolicy
+
+	// optional, who deploys run as (Group defaults to User's). Deploys
+	// can only say otherwise in their deploy.json if User isn't set.
+	User  string
+	Group string
+
+	// optional, lets deploys run as root if their deploy.json says so
+	AllowRoot bool
 }
 
 type ServerImpl struct {
-	root         string
+	root string
+
+	// Held by the server for as long as it runs, see lockRoot
+	rootLock *os.File
+
+	// Serializes the changes to the config, deploys and haproxy, which
+	// come from concurrent rpcs and the enforce loop. Held for reading
+	// while listing deploys. It isn't held while waiting on a deploy, e.g.
+	// for it to start up or stop, or for its hooks; see busy.
+	lock sync.RWMutex
+
+	// deploys being run, stopped, set or restarted, by the port they're
+	// on. Other changes to them are refused until that's done, and
+	// they're left alone by the enforce loop and prune. Guarded by lock.
+	busy map[string]int
+
 	config       Config
 	startPort    int
 	endPort      int
 	client       *http.Client
 	deploysPath  string
 	enforceDelay time.Duration
+
+	// supervisors of the processes started by this server, see runnerKey
+	runners     map[string]*Runner
+	runnersLock sync.Mutex
+
+	// set by Shutdown, after which no more runners are started. Set
+	// holding lock and runnersLock, so it's read holding runnersLock.
+	shuttingDown bool
+
+	// the goroutines running the runners' RunLoops, see supervise
+	supervisors sync.WaitGroup
+
+	// records of the processes started by this server or a previous one,
+	// see ProcessRecord
+	state     map[string]*ProcessRecord
+	stateLock sync.Mutex
+
+	// serializes appending to and reading the audit log
+	auditLock sync.Mutex
+
+	// failures of the enforce loop to start processes, by runnerKey, see
+	// restartBackoff
+	startFailures map[string]*restartBackoff
+
+	// where deploys' cgroups go, see deployCgroup
+	cgroupOnce   sync.Once
+	cgroupParent string
+	cgroupErr    error
 }
 
 func readConfig(path string) (Config, error) {
 	config := Config{
-		Ports: map[int]string{},
+		Ports:        map[int]string{},
+		ProcessPorts: map[string]map[string]int{},
 	}
 	if data, err := ioutil.ReadFile(path); err == nil {
 		c := struct {
-			Ports map[string]string
+			Ports        map[string]string
+			ProcessPorts map[string]map[string]int
+			Active       string
+			Pinned       []string
+			Retention    *RetentionPolicy
+			User         string
+			Group        string
+			AllowRoot    bool
 		}{}
-		err = json.Unmarshal(data, &c)
+		err = unmarshalConfig(data, &c)
 		if err != nil {
-			return Config{}, err
+			return Config{}, fmt.Errorf("%s: %s", serverConfigFileName, err)
+		}
+		if c.Group != "" && c.User == "" {
+			return Config{}, fmt.Errorf("%s: Group needs a User", serverConfigFileName)
 		}
+		if c.Retention != nil {
+			if _, err := c.Retention.maxAge(); err != nil {
+				return Config{}, fmt.Errorf("%s: %s", serverConfigFileName, err)
+			}
+		}
+		config.Active = c.Active
+		config.Pinned = c.Pinned
+		config.Retention = c.Retention
+		config.User = c.User
+		config.Group = c.Group
+		config.AllowRoot = c.AllowRoot
 		for portStr, deployId := range c.Ports {
 			port, err := strconv.Atoi(portStr)
 			if err != nil {
@@ -102,6 +215,9 @@ func readConfig(path string) (Config, error) {
 			}
 			config.Ports[port] = deployId
 		}
+		for deployId, ports := range c.ProcessPorts {
+			config.ProcessPorts[deployId] = ports
+		}
 	}
 	return config, nil
 }
@@ -115,29 +231,43 @@ func NewServerImpl(
 	if err != nil {
 		log.Fatal("Root path:", err)
 	}
+	rootLock, err := lockRoot(root)
+	if err != nil {
+		return nil, err
+	}
 	config, err := readConfig(path.Join(root, serverConfigFileName))
 	if err != nil {
+		rootLock.Close()
 		return nil, err
 	}
+	state, err := readState(path.Join(root, serverStateFileName))
+	if err != nil {
+		rootLock.Close()
+		return nil, fmt.Errorf("%s: %s", serverStateFileName, err)
+	}
 	deploysPath := path.Join(root, deploysDirName)
 	if _, err = os.Open(deploysPath); os.IsNotExist(err) {
 		os.MkdirAll(deploysPath, 0744)
 	}
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return errors.New("health check should not redirect")
-		},
-		Timeout: MAX_HEALTH_CHECK_TIME,
-	}
+	client := newHealthCheckClient()
 
 	server := &ServerImpl{
-		root:         root,
-		config:       config,
-		startPort:    portBase + 1,
-		endPort:      portBase + 99,
-		client:       client,
-		deploysPath:  deploysPath,
-		enforceDelay: time.Duration(5) * time.Second,
+		root:          root,
+		rootLock:      rootLock,
+		config:        config,
+		startPort:     portBase + 1,
+		endPort:       portBase + 99,
+		client:        client,
+		deploysPath:   deploysPath,
+		enforceDelay:  time.Duration(5) * time.Second,
+		runners:       map[string]*Runner{},
+		state:         state,
+		startFailures: map[string]*restartBackoff{},
+		busy:          map[string]int{},
+	}
+
+	if err := server.restoreActive(); err != nil {
+		log.Printf("restore active deploy: %s\n", err)
 	}
 
 	if autoEnforce {
@@ -166,46 +296,183 @@ func (s *ServerImpl) deployConfigFile(deployId string) string {
 	return path.Join(s.deployDir(deployId), deployConfigFileName)
 }
 
+// deployTarget returns the name of the target the deploy was pushed to, as
+// recorded by the client, or "" if it was not recorded.
+func (s *ServerImpl) deployTarget(deployId string) TargetName {
+	data, err := ioutil.ReadFile(path.Join(s.deployDir(deployId), deployTargetFileName))
+	if err != nil {
+		return ""
+	}
+	return TargetName(strings.TrimSpace(string(data)))
+}
+
+// envKeys returns the names of the app's Env variables for the target.
+func envKeys(app Application, target TargetName) []string {
+	keys := []string{}
+	for key := range app.Env(target) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (s *ServerImpl) EnforceLoop() {
 	for {
 		s.Enforce()
+		s.enforceRetention()
 		time.Sleep(s.enforceDelay)
 	}
 }
 
+// enforceRestart is what Enforce has to start of a configured deploy.
+type enforceRestart struct {
+	deployId  string
+	port      int
+	app       Application
+	procPorts map[string]int
+
+	// the main RunCmd, if it isn't running
+	main bool
+	// the additional processes that aren't running
+	procs []*AppProcess
+
+	results []*enforceResult
+}
+
+type enforceResult struct {
+	key  string
+	what string
+	err  error
+}
+
 func (s *ServerImpl) Enforce() {
-	procs := FindListeningProcesses(s.startPort, s.endPort)
+	s.lock.Lock()
+	restarts := s.enforceRestarts()
+	s.lock.Unlock()
+
+	// started in parallel, without holding s.lock while they start up
+	var wg sync.WaitGroup
+	for _, r := range restarts {
+		wg.Add(1)
+		go func(r *enforceRestart) {
+			defer wg.Done()
+			s.enforceStart(r)
+		}(r)
+	}
+	wg.Wait()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range restarts {
+		for _, result := range r.results {
+			if result.err != nil && s.runner(result.key) == nil {
+				delay := s.startFailed(result.key, result.err)
+				fmt.Printf("failed to start %s: %s, retrying in %s\n", result.what, result.err, delay)
+			} else if result.err == nil {
+				delete(s.startFailures, result.key)
+			}
+		}
+		delete(s.busy, r.deployId)
+	}
+}
+
+// enforceRestarts works out what Enforce has to start, claiming those
+// deploys (see busy). The caller holds s.lock.
+func (s *ServerImpl) enforceRestarts() []*enforceRestart {
+	procs := s.findListeningProcesses()
 	procsByPort := makeProcessPortLookup(procs)
+	restarts := []*enforceRestart{}
 	for port, deployId := range s.config.Ports {
-		// deployId should be running on port.
-		running, ok := procsByPort[port]
-		if !ok {
-			// Nothing is running on port, so we should run our deploy.
-			// TODO(koz): Wait for health of all started deploys in parallel.
-			s.startDeployAndWaitForHealth(deployId, port)
+		if _, busy := s.busy[deployId]; busy {
 			continue
 		}
-
-		//process is running, now check it's the *right* one
-		//if the deploy has written to a pid file then trust this app-specific override
-		if pid, err := s.getDeployPidOverride(deployId); err != nil {
-			fmt.Printf("warning: could not read deploy %s's pid file: %s\n", deployId, err)
-		} else if pid < 0 {
-			//no pid override
-		} else if running.Pid == pid {
-			continue
+		r := &enforceRestart{
+			deployId:  deployId,
+			port:      port,
+			procPorts: s.config.ProcessPorts[deployId],
 		}
-
-		//otherwise, check the default: the deployed app in the deploy dir on the deploy port
-		if running.DeployId != deployId {
-			runningDeploy := running.DeployId
-			if runningDeploy == "" {
-				runningDeploy = fmt.Sprintf("(pid:%d)", running.Pid)
+		app, appErr := ApplicationFromConfig(false, s.deployConfigFile(deployId), "")
+		if appErr == nil {
+			r.app = app
+			for _, proc := range app.Processes() {
+				key := runnerKey(deployId, proc.Name)
+				if !s.processRunning(deployId, proc.Name) && !s.startBackedOff(key) {
+					r.procs = append(r.procs, proc)
+				}
 			}
-			// Something unexpected is running on port, so report it.
-			fmt.Printf("%s, not %s is running on %d\n", runningDeploy, deployId, port)
-			continue
 		}
+		r.main = s.runner(runnerKey(deployId, "")) == nil &&
+			s.mainNeedsStart(deployId, port, procsByPort)
+
+		if r.main && appErr != nil {
+			s.audit(Caller{}, auditRestart, deployId, port, "", appErr)
+			delay := s.startFailed(runnerKey(deployId, ""), appErr)
+			fmt.Printf("failed to start %s: %s, retrying in %s\n", deployId, appErr, delay)
+			r.main = false
+		}
+		if r.main || len(r.procs) > 0 {
+			s.busy[deployId] = port
+			restarts = append(restarts, r)
+		}
+	}
+	return restarts
+}
+
+// mainNeedsStart is true if nothing is running on the port the deploy is
+// configured for, and it isn't backed off. It reports anything unexpected
+// running there. The caller holds s.lock.
+func (s *ServerImpl) mainNeedsStart(deployId string, port int, procsByPort map[int]Process) bool {
+	// deployId should be running on port.
+	running, ok := procsByPort[port]
+	if !ok {
+		// Nothing is running on port, so we should run our deploy.
+		return !s.startBackedOff(runnerKey(deployId, ""))
+	}
+
+	//process is running, now check it's the *right* one
+	//if the deploy has written to a pid file then trust this app-specific override
+	if pid, err := s.getDeployPidOverride(deployId); err != nil {
+		fmt.Printf("warning: could not read deploy %s's pid file: %s\n", deployId, err)
+	} else if pid < 0 {
+		//no pid override
+	} else if running.Pid == pid {
+		return false
+	}
+
+	//otherwise, check the default: the deployed app in the deploy dir on the deploy port
+	if running.DeployId != deployId {
+		runningDeploy := running.DeployId
+		if runningDeploy == "" {
+			runningDeploy = fmt.Sprintf("(pid:%d)", running.Pid)
+		}
+		// Something unexpected is running on port, so report it.
+		fmt.Printf("%s, not %s is running on %d\n", runningDeploy, deployId, port)
+	}
+	return false
+}
+
+// enforceStart starts what Enforce found wasn't running of a deploy, and
+// waits for it to start up.
+func (s *ServerImpl) enforceStart(r *enforceRestart) {
+	for _, proc := range r.procs {
+		fmt.Printf("process %s of %s is not running, starting it\n", proc.Name, r.deployId)
+		port := r.procPorts[proc.Name]
+		err := s.startProcess(r.deployId, r.app, proc, port)
+		s.audit(Caller{}, auditRestart, r.deployId, port, proc.Name, err)
+		r.results = append(r.results, &enforceResult{
+			key:  runnerKey(r.deployId, proc.Name),
+			what: fmt.Sprintf("process %s of %s", proc.Name, r.deployId),
+			err:  err,
+		})
+	}
+	if r.main {
+		err := s.superviseDeploy(r.deployId, r.app, r.port)
+		s.audit(Caller{}, auditRestart, r.deployId, r.port, "", err)
+		r.results = append(r.results, &enforceResult{
+			key:  runnerKey(r.deployId, ""),
+			what: r.deployId,
+			err:  err,
+		})
 	}
 }
 
@@ -236,30 +503,18 @@ func makeProcessPidLookup(procs []Process) map[int]Process {
 	return result
 }
 
-func makeProcessDeployIdLookup(procs []Process) map[string]Process {
+// makeProcessDeployIdLookup maps deploy ids to the process running the
+// deploy's main RunCmd (i.e. ignoring its additional processes).
+func (s *ServerImpl) makeProcessDeployIdLookup(procs []Process) map[string]Process {
 	result := map[string]Process{}
 	for _, proc := range procs {
-		result[proc.DeployId] = proc
+		if !s.isProcessPort(proc.Port) {
+			result[proc.DeployId] = proc
+		}
 	}
 	return result
 }
 
-func (s *ServerImpl) startDeployAndWaitForHealth(deployId string, port int) error {
-	app, cmd, err := s.commandForDeploy(deployId, port)
-	if err != nil {
-		return err
-	}
-
-	if err := cmd.Start(); err != nil {
-		return err
-	}
-
-	if err := s.waitForAppToStart(port, app); err != nil {
-		return err
-	}
-	return nil
-}
-
 func (s *ServerImpl) readDeployIdsFromDisk() []string {
 	infos, err := ioutil.ReadDir(s.deploysPath)
 	if err != nil {
@@ -272,12 +527,20 @@ func (s *ServerImpl) readDeployIdsFromDisk() []string {
 	return result
 }
 
-func (s *ServerImpl) checkAllHealth(deploys []*Deploy) {
+// listedDeploy is a deploy being listed, with its config as ListDeploys
+// loaded it.
+type listedDeploy struct {
+	*Deploy
+	app    Application
+	appErr error
+}
+
+func (s *ServerImpl) checkAllHealth(deploys []*listedDeploy) {
 	healthChecks := 0
 	checkSync := make(chan int)
 	for _, deploy := range deploys {
 		healthChecks++
-		go func(deploy *Deploy) {
+		go func(deploy *listedDeploy) {
 			s.checkHealth(deploy)
 			checkSync <- 0
 		}(deploy)
@@ -290,11 +553,13 @@ func (s *ServerImpl) checkAllHealth(deploys []*Deploy) {
 }
 
 func (s *ServerImpl) ListDeploys() ([]*Deploy, error) {
-	procs := FindListeningProcesses(s.startPort, s.endPort)
-	procsByDeployId := makeProcessDeployIdLookup(procs)
+	s.lock.RLock()
+
+	procs := s.findListeningProcesses()
+	procsByDeployId := s.makeProcessDeployIdLookup(procs)
 	procsByPid := makeProcessPidLookup(procs)
 	unaccountedProcsByPort := makeProcessPortLookup(procs)
-	knownRunningDeploys := []*Deploy{}
+	knownRunningDeploys := []*listedDeploy{}
 	deployIds := s.readDeployIdsFromDisk()
 	knownDeploys := []*Deploy{}
 	setPort, err := getPortMarkedAsSet(s.endPort)
@@ -309,19 +574,40 @@ func (s *ServerImpl) ListDeploys() ([]*Deploy, error) {
 				proc, running = procsByPid[pidOverride]
 			}
 		}
+		// each read once, there may be hundreds of deploys
+		app, appErr := ApplicationFromConfig(false, s.deployConfigFile(deployId), "")
+		meta := s.deployMeta(deployId)
 		deploy := &Deploy{
 			Id:      deployId,
 			Pid:     proc.Pid,
 			Port:    proc.Port,
-			Set:     proc.Port == setPort,
+			Set:     s.isSet(deployId, proc.Port, setPort),
 			Tracked: s.lookupConfiguredPort(deployId) != 0,
+			Pinned:  s.isPinned(deployId),
+			Meta:    meta,
+			Created: s.deployCreated(deployId, meta),
+			Target:  s.deployTarget(deployId),
+		}
+		deploy.Status, deploy.Errors = s.runnerStatus(runnerKey(deployId, ""))
+		processRunning := false
+		if appErr == nil {
+			deploy.EnvKeys = envKeys(app, deploy.Target)
+			deploy.Processes = s.listProcesses(deployId, app)
+			for _, p := range deploy.Processes {
+				if p.Pid != 0 {
+					processRunning = true
+					delete(unaccountedProcsByPort, p.Port)
+				}
+			}
 		}
 		if running {
 			delete(unaccountedProcsByPort, proc.Port)
-			knownRunningDeploys = append(knownRunningDeploys, deploy)
 		} else {
 			deploy.Port = s.lookupConfiguredPort(deployId)
 		}
+		if running || processRunning {
+			knownRunningDeploys = append(knownRunningDeploys, &listedDeploy{deploy, app, appErr})
+		}
 		knownDeploys = append(knownDeploys, deploy)
 	}
 	// Any processes that haven't been accounted for yet, we list them as deploys, too.
@@ -335,29 +621,43 @@ func (s *ServerImpl) ListDeploys() ([]*Deploy, error) {
 			Tracked: false,
 		})
 	}
+	s.lock.RUnlock()
+
+	// which can take a while, so is done without the lock
 	s.checkAllHealth(knownRunningDeploys)
 	return append(knownDeploys, unaccounted...), nil
 }
 
-func (s *ServerImpl) checkHealth(deploy *Deploy) {
-	app, err := ApplicationFromConfig(false, s.deployConfigFile(deploy.Id))
-	if err != nil {
+// isSet is true if the deploy is the active one, going by haproxy's status
+// page (setPort) for servers that haven't recorded it.
+func (s *ServerImpl) isSet(deployId string, port int, setPort int) bool {
+	if s.config.Active != "" {
+		return deployId == s.config.Active
+	}
+	return port != 0 && port == setPort
+}
+
+func (s *ServerImpl) checkHealth(deploy *listedDeploy) {
+	app := deploy.app
+	if deploy.appErr != nil {
 		deploy.Errors = append(deploy.Errors,
-			fmt.Sprintf("Missing deploy config (%s)", err))
+			fmt.Sprintf("Missing deploy config (%s)", deploy.appErr))
 		println("Missing config")
 		deploy.Health = -2
 		return
 	}
 
-	status, err := s.testApp(deploy.Port, app)
-	if err != nil {
-		deploy.Errors = append(deploy.Errors, fmt.Sprintf("%s", err))
-		log.Println("Got http err ", err, " for ", deploy.Id)
-		deploy.Health = -1
-		return
+	if deploy.Pid != 0 {
+		vars := s.runVars(deploy.Id, app, deploy.Port)
+		status, err := s.testApp(app, vars, app.HealthCheck(vars.Target))
+		deploy.Health = status
+		if err != nil {
+			deploy.Errors = append(deploy.Errors, fmt.Sprintf("%s", err))
+			log.Println("Got health check err ", err, " for ", deploy.Id)
+		}
 	}
 
-	deploy.Health = status
+	s.checkProcessHealth(deploy.Deploy, app)
 }
 
 func (s *ServerImpl) findUnusedPort() (int, error) {
@@ -382,7 +682,12 @@ func (s *ServerImpl) lookupConfiguredPort(deployId string) int {
 
 func (s *ServerImpl) portConfigured(port int) bool {
 	_, taken := s.config.Ports[port]
-	return taken
+	for _, busyPort := range s.busy {
+		// e.g. being stopped, or claimed by a run that hasn't configured it
+		// yet
+		taken = taken || busyPort == port
+	}
+	return taken || s.isProcessPort(port)
 }
 
 func portFree(port int) bool {
@@ -401,9 +706,23 @@ func portFree(port int) bool {
 
 func (s *ServerImpl) writeConfig() error {
 	c := struct {
-		Ports map[string]string
+		Ports        map[string]string
+		ProcessPorts map[string]map[string]int
+		Active       string           `json:",omitempty"`
+		Pinned       []string         `json:",omitempty"`
+		Retention    *RetentionPolicy `json:",omitempty"`
+		User         string           `json:",omitempty"`
+		Group        string           `json:",omitempty"`
+		AllowRoot    bool             `json:",omitempty"`
 	}{
-		Ports: map[string]string{},
+		Ports:        map[string]string{},
+		ProcessPorts: s.config.ProcessPorts,
+		Active:       s.config.Active,
+		Pinned:       s.config.Pinned,
+		Retention:    s.config.Retention,
+		User:         s.config.User,
+		Group:        s.config.Group,
+		AllowRoot:    s.config.AllowRoot,
 	}
 	for port, deployId := range s.config.Ports {
 		c.Ports[strconv.Itoa(port)] = deployId
@@ -412,22 +731,148 @@ func (s *ServerImpl) writeConfig() error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path.Join(s.root, serverConfigFileName),
+	return writeFileAtomic(path.Join(s.root, serverConfigFileName),
 		data, os.FileMode(0644))
 }
 
+// writeFileAtomic writes file by renaming a temporary file over it, so
+// readers (and a crash) see either the old or the new contents.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// lockRoot takes an exclusive lock on the server root, so that two servers
+// can't manage the same deploys. It's released when the server exits.
+func lockRoot(root string) (*os.File, error) {
+	file := path.Join(root, serverLockFileName)
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Lock %s: %s", root, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			pid, _ := readPid(file)
+			return nil, fmt.Errorf("Another camus server (pid %d) is using %s", pid, root)
+		}
+		return nil, fmt.Errorf("Lock %s: %s", root, err)
+	}
+	// so that the next server can say who has it
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	return f, nil
+}
+
 func (s *ServerImpl) SetActiveByPort(port int) error {
-	return s.reloadHaproxy(port)
+	s.lock.Lock()
+	// "" if it isn't a configured deploy, which can't be restored, and
+	// has no hooks
+	deployId := s.config.Ports[port]
+	if deployId == "" {
+		defer s.lock.Unlock()
+		return s.switchActive("", port)
+	}
+	err := s.claim(deployId, port)
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	defer s.release(deployId)
+	return s.setActiveWithHooks(deployId, port)
 }
 
 func (s *ServerImpl) SetActiveById(id string) error {
-	for port, deployId := range s.config.Ports {
-		if deployId == id {
-			return s.reloadHaproxy(port)
+	port, err := s.claimConfigured(id)
+	if err != nil {
+		return err
+	} else if port == 0 {
+		return fmt.Errorf("No deploy %s, run 'list' to see valid deploys", id)
+	}
+	defer s.release(id)
+	return s.setActiveWithHooks(id, port)
+}
+
+// setActiveWithHooks points haproxy at the deploy on port, running its
+// pre-set and post-set hooks. The caller has claimed the deploy. If its
+// config can't be read it's still set live, as before there were hooks, so
+// a broken deploy.json can't stop it being rolled back to.
+func (s *ServerImpl) setActiveWithHooks(deployId string, port int) error {
+	app, err := ApplicationFromConfig(false, s.deployConfigFile(deployId), "")
+	if err != nil {
+		log.Printf("%s: %s, setting it live without hooks\n", deployId, err)
+		app = nil
+	}
+	if app != nil {
+		if err := s.runHook(app, hookPreSet, deployId, port); err != nil {
+			return err
 		}
 	}
+	s.lock.Lock()
+	err = s.switchActive(deployId, port)
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if app != nil {
+		s.runPostHook(app, hookPostSet, deployId, port)
+	}
+	return nil
+}
 
-	return fmt.Errorf("No deploy %s, run 'list' to see valid deploys", id)
+// switchActive points haproxy at port, and records deployId as the active
+// deploy. The caller holds s.lock.
+func (s *ServerImpl) switchActive(deployId string, port int) error {
+	if err := s.reloadHaproxy(port); err != nil {
+		return err
+	}
+	return s.setActive(deployId)
+}
+
+func (s *ServerImpl) setActive(deployId string) error {
+	if s.config.Active == deployId {
+		return nil
+	}
+	s.config.Active = deployId
+	if err := s.writeConfig(); err != nil {
+		return fmt.Errorf("write config: %s", err)
+	}
+	return nil
+}
+
+// restoreActive points haproxy back at the active deploy when the server
+// starts, starting haproxy if need be (e.g. after a reboot). With -enforce
+// the deploy itself is started by the enforce loop.
+func (s *ServerImpl) restoreActive() error {
+	if s.config.Active == "" {
+		return nil
+	}
+	port := s.lookupConfiguredPort(s.config.Active)
+	if port == 0 {
+		return fmt.Errorf("Active deploy %s is no longer configured to run", s.config.Active)
+	}
+	log.Printf("pointing haproxy at %s on %d\n", s.config.Active, port)
+	return s.reloadHaproxy(port)
 }
 
 func (s *ServerImpl) GetFullDeployIdFromShortName(deployShortName string) (string, error) {
@@ -450,133 +895,216 @@ func (s *ServerImpl) GetFullDeployIdFromShortName(deployShortName string) (strin
 	return matchingIds[0], nil
 }
 
-func (s *ServerImpl) Run(deployIdToRun string) (int, error) {
-	for port, deployId := range s.config.Ports {
-		if deployIdToRun == deployId {
+// claim marks the deploy on port as busy, failing if it already is. It
+// must be released once done. The caller holds s.lock.
+func (s *ServerImpl) claim(deployId string, port int) error {
+	if _, busy := s.busy[deployId]; busy {
+		return fmt.Errorf("Deploy %s is being changed by another command, try again once it's done",
+			deployId)
+	}
+	s.busy[deployId] = port
+	return nil
+}
+
+// release marks the deploy as no longer busy.
+func (s *ServerImpl) release(deployId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.busy, deployId)
+}
+
+// claimConfigured claims the deploy (see claim), returning the port it's
+// configured to run on, or 0 without claiming it if it isn't.
+func (s *ServerImpl) claimConfigured(deployId string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	port := s.lookupConfiguredPort(deployId)
+	if port == 0 {
+		return 0, nil
+	}
+	return port, s.claim(deployId, port)
+}
+
+// claimUnusedPort claims the deploy (see claim) along with a port for it to
+// run on, which it isn't configured for yet.
+func (s *ServerImpl) claimUnusedPort(deployId string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for port, id := range s.config.Ports {
+		if deployId == id {
 			return -1, fmt.Errorf("Already configured for port %d", port)
 		}
 	}
-
 	port, err := s.findUnusedPort()
 	if err != nil {
 		return -1, err
 	}
+	return port, s.claim(deployId, port)
+}
+
+// configurePorts configures the deploy to run on port, and allocates ports
+// for its processes, which it returns.
+func (s *ServerImpl) configurePorts(deployId string, app Application, port int) (map[string]int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.config.Ports[port] = deployId
+	if err := s.allocateProcessPorts(deployId, app); err != nil {
+		delete(s.config.Ports, port)
+		return nil, err
+	}
+	if err := s.writeConfig(); err != nil {
+		return nil, fmt.Errorf("write config: %s", err)
+	}
+	return s.config.ProcessPorts[deployId], nil
+}
+
+// unconfigure removes the deploy from the config, so it isn't restarted.
+func (s *ServerImpl) unconfigure(deployId string, port int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.config.Ports, port)
+	delete(s.config.ProcessPorts, deployId)
+	s.forgetStartFailures(deployId)
+	if s.config.Active == deployId {
+		// nothing to restore haproxy to
+		s.config.Active = ""
+	}
+	if err := s.writeConfig(); err != nil {
+		return fmt.Errorf("write config: %s", err)
+	}
+	return nil
+}
 
-	app, cmd, err := s.commandForDeploy(deployIdToRun, port)
+// Run configures the deploy to run on a free port and starts it, waiting
+// for it to start up. The deploy's pre-run hook is run before, and its
+// post-run hook after.
+func (s *ServerImpl) Run(deployIdToRun string) (int, error) {
+	port, err := s.claimUnusedPort(deployIdToRun)
 	if err != nil {
 		return -1, err
 	}
+	defer s.release(deployIdToRun)
 
-	s.config.Ports[port] = deployIdToRun
-	err = s.writeConfig()
+	app, err := ApplicationFromConfig(false, s.deployConfigFile(deployIdToRun), "")
 	if err != nil {
-		return -1, fmt.Errorf("write config: %s", err)
+		return -1, err
+	}
+
+	if err := s.runHook(app, hookPreRun, deployIdToRun, port); err != nil {
+		return -1, err
 	}
 
-	err = cmd.Start()
+	procPorts, err := s.configurePorts(deployIdToRun, app, port)
 	if err != nil {
 		return -1, err
 	}
 
-	if err := s.waitForAppToStart(port, app); err != nil {
+	if err := s.superviseDeploy(deployIdToRun, app, port); err != nil {
+		return -1, err
+	}
+
+	if err := s.startProcesses(deployIdToRun, app, procPorts); err != nil {
 		return -1, err
 	}
 
+	s.runPostHook(app, hookPostRun, deployIdToRun, port)
 	return port, nil
 }
 
-func (s *ServerImpl) Stop(deployIdToStop string) error {
-	procs := FindListeningProcesses(s.startPort, s.endPort)
-	procsByDeployId := makeProcessDeployIdLookup(procs)
-	proc, running := procsByDeployId[deployIdToStop]
-	port := s.lookupConfiguredPort(deployIdToStop)
-	if port == 0 {
-		return fmt.Errorf("Deploy not running or not on a port")
-	}
-
-	delete(s.config.Ports, port)
-	err := s.writeConfig()
+// Stop stops the deploy and its processes, giving them the app's
+// StopTimeout to exit, and reports how each one ended. Unless force is
+// true, the deploy's pre-stop hook is run first.
+func (s *ServerImpl) Stop(deployIdToStop string, force bool) ([]*StopResult, error) {
+	port, err := s.claimConfigured(deployIdToStop)
 	if err != nil {
-		return fmt.Errorf("write config: %s", err)
+		return nil, err
+	} else if port == 0 {
+		return nil, fmt.Errorf("Deploy not running or not on a port")
 	}
-
-	//kill the proc *after* removing it from the list so it doesn't auto-restart
-	if running {
-		if p, err := os.FindProcess(proc.Pid); err == nil {
-			//try to kill by process group id so the whole bundle incl. children gets cleaned up
-			if pgid, pgerr := syscall.Getpgid(proc.Pid); pgerr == nil {
-				syscall.Kill(-pgid, 15) //minus is required
-			} else {
-				p.Kill()
+	defer s.release(deployIdToStop)
+
+	timeout := defaultStopTimeout
+	if app, err := ApplicationFromConfig(false, s.deployConfigFile(deployIdToStop), ""); err == nil {
+		timeout = app.StopTimeout()
+		if !force {
+			if err := s.runHook(app, hookPreStop, deployIdToStop, port); err != nil {
+				return nil, fmt.Errorf("%s (stop with -force to skip it)", err)
 			}
-		} else {
-			return fmt.Errorf("Failed to kill pid %s", proc.Pid)
 		}
-	} else {
-		return fmt.Errorf("Deploy not running")
 	}
-	return nil
-}
 
-func (s *ServerImpl) commandForDeploy(deployIdToRun string, port int) (Application, *exec.Cmd, error) {
-	deployPath := s.deployDir(deployIdToRun)
-	app, err := ApplicationFromConfig(false,
-		path.Join(deployPath, "deploy.json"))
-
-	if err != nil {
-		return nil, nil, err
+	if err := s.unconfigure(deployIdToStop, port); err != nil {
+		return nil, err
 	}
-	cmd := exec.Command("sh", "-c", app.RunCmd(port))
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	cmd.Dir = deployPath
-	detachProc(cmd)
-	return app, cmd, nil
-}
 
-func detachProc(cmd *exec.Cmd) {
-	// give it its own process group, so it doesn't die
-	// when the manager process exits for whatever reason
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	//kill the procs *after* removing them from the list so they don't auto-restart
+	var main *StopResult
+	mainStopped := make(chan int)
+	go func() {
+		main = s.stopMain(deployIdToStop, timeout)
+		close(mainStopped)
+	}()
+	results := s.stopProcesses(deployIdToStop, timeout)
+	<-mainStopped
+	if main == nil {
+		return nil, fmt.Errorf("Deploy not running")
+	}
+	return append([]*StopResult{main}, results...), nil
 }
 
-var MAX_STARTUP_TIME = time.Duration(20) * time.Second
-var MAX_HEALTH_CHECK_TIME = time.Duration(2) * time.Second
-var STARTUP_HEALTH_CHECK_INTERVAL = time.Duration(100) * time.Millisecond
-
-func (s *ServerImpl) waitForAppToStart(port int, app Application) error {
-	end := time.Now().Add(MAX_STARTUP_TIME)
-	for {
-		log.Print(".")
-
-		status, err := s.testApp(port, app)
+// stopMain stops the process running the deploy's main RunCmd, returning
+// nil if there isn't one.
+func (s *ServerImpl) stopMain(deployId string, timeout time.Duration) *StopResult {
+	if result := s.stopRunner(runnerKey(deployId, "")); result != nil {
+		return result
+	}
 
-		if err == nil {
-			if status == 200 {
-				log.Println("ok")
-				return nil
-			} else {
-				log.Println("bad:", status)
-				return errors.New(fmt.Sprintf("Health check failed %d", status))
-			}
-		}
+	// not started by this server, but maybe a previous one
+	key := runnerKey(deployId, "")
+	if r := s.liveRecord(key); r != nil {
+		result := stopProcessGroup(r.Pid, timeout, nil)
+		s.forgetProcess(key, r.Pid)
+		return result
+	}
 
-		if time.Now().After(end) {
-			return errors.New("Failed to connect to app after timeout")
-		}
+	// or by hand, find it by its port
+	procs := s.findListeningProcesses()
+	if proc, running := s.makeProcessDeployIdLookup(procs)[deployId]; running {
+		return stopProcessGroup(proc.Pid, timeout, nil)
+	}
+	return nil
+}
 
-		time.Sleep(STARTUP_HEALTH_CHECK_INTERVAL)
+// runVars returns the variables to substitute into the deploy's commands.
+// port is 0 for processes without a port.
+func (s *ServerImpl) runVars(deployId string, app Application, port int) RunVars {
+	return RunVars{
+		Port:       port,
+		DeployId:   deployId,
+		DeployDir:  s.deployDir(deployId),
+		Target:     s.deployTarget(deployId),
+		ServerRoot: s.root,
+		FrontPort:  s.endPort - 1,
+		Vars:       app.Vars(),
 	}
 }
 
-func (s *ServerImpl) testApp(port int, app Application) (int, error) {
-	resp, err := s.client.Get(
-		fmt.Sprintf("http://localhost:%d%s", port, app.HealthEndpoint()))
+func detachProc(cmd *exec.Cmd) {
+	// give it its own session, and so process group, so it doesn't die
+	// when the manager process exits for whatever reason, and anything
+	// it starts can be told apart (see recordedOwner)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
 
-	if err == nil {
-		return resp.StatusCode, nil
+func (s *ServerImpl) testApp(app Application, vars RunVars, hc *HealthCheck) (int, error) {
+	cred, err := s.credential(app)
+	if err != nil {
+		return -1, err
 	}
-
-	return -1, err
+	hc = hc.Expand(vars)
+	hc.Credential = cred
+	hc.Env = s.appEnv(app, vars)
+	return hc.Check(s.client, vars.DeployDir, vars.Port)
 }
 
 func (s *ServerImpl) reloadHaproxy(port int) error {
@@ -588,7 +1116,7 @@ func (s *ServerImpl) reloadHaproxy(port int) error {
 	cfgFile := path.Join(s.root, haproxyConfig)
 	pidFile := path.Join(s.root, haproxyPid)
 
-	if err := ioutil.WriteFile(cfgFile, []byte(cfg), os.FileMode(0644)); err != nil {
+	if err := writeFileAtomic(cfgFile, []byte(cfg), os.FileMode(0644)); err != nil {
 		return err
 	}
 
@@ -596,6 +1124,10 @@ func (s *ServerImpl) reloadHaproxy(port int) error {
 	if err != nil {
 		return err
 	}
+	if runningPid > 0 && !haproxyAlive(runningPid) {
+		// left over from before a reboot, the pid may have been reused
+		runningPid = -1
+	}
 
 	cmd := haproxyCmd(cfgFile, pidFile, runningPid)
 
@@ -625,6 +1157,19 @@ func haproxyCmd(cfgFile string, pidFile string, runningPid int) *exec.Cmd {
 	return cmd
 }
 
+// haproxyAlive is true if pid is a running haproxy.
+func haproxyAlive(pid int) bool {
+	if !processAlive(pid) {
+		return false
+	}
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		// no /proc, assume it is
+		return true
+	}
+	return strings.Contains(string(comm), "haproxy")
+}
+
 func readPid(pidFile string) (int, error) {
 	if data, err := ioutil.ReadFile(pidFile); err == nil {
 		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
@@ -649,7 +1194,7 @@ func contains(strs []string, str string) bool {
 
 // TODO(koz): Don't return haproxy processes here.
 func (s *ServerImpl) findUnknownProcesses() []Process {
-	procs := FindListeningProcesses(s.startPort, s.endPort)
+	procs := s.findListeningProcesses()
 	deployIds := s.readDeployIdsFromDisk()
 	unknown := []Process{}
 	for _, proc := range procs {
@@ -660,21 +1205,42 @@ func (s *ServerImpl) findUnknownProcesses() []Process {
 	return unknown
 }
 
-func (s *ServerImpl) KillUnknownProcesses() {
+// KillUnknownProcesses stops the processes in the range of camus that
+// aren't deploys, and reports how each one ended.
+func (s *ServerImpl) KillUnknownProcesses() []*StopResult {
+	s.lock.RLock()
+	pids := []int{}
 	for _, proc := range s.findUnknownProcesses() {
-		if p, err := os.FindProcess(proc.Pid); err == nil {
-			p.Kill()
-		}
+		pids = append(pids, proc.Pid)
 	}
+	s.lock.RUnlock()
+	return stopPids(pids, defaultStopTimeout)
 }
 
-// Shutdown kills all processes in the range of camus and then exits.
+// Shutdown stops all processes in the range of camus and then exits.
 func (s *ServerImpl) Shutdown() {
-	procs := FindListeningProcesses(s.startPort, s.endPort)
-	for _, proc := range procs {
-		if p, err := os.FindProcess(proc.Pid); err == nil {
-			p.Kill()
+	// never released, the server exits
+	s.lock.Lock()
+	// deploys being run or restarted don't hold the lock, see busy
+	s.runnersLock.Lock()
+	s.shuttingDown = true
+	s.runnersLock.Unlock()
+
+	s.stopAllRunners()
+	s.supervisors.Wait()
+	for _, deployId := range s.readDeployIdsFromDisk() {
+		timeout := defaultStopTimeout
+		if app, err := ApplicationFromConfig(false, s.deployConfigFile(deployId), ""); err == nil {
+			timeout = app.StopTimeout()
 		}
+		s.stopProcesses(deployId, timeout)
+	}
+	pids := []int{}
+	for _, proc := range s.findListeningProcesses() {
+		pids = append(pids, proc.Pid)
+	}
+	for _, result := range stopPids(pids, defaultStopTimeout) {
+		log.Printf("shutdown: %s\n", result)
 	}
 	os.Exit(0)
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server with a temp root, which is removed, and
+// the deploys it's supervising stopped, when the test ends.
+func newTestServer(t *testing.T) *ServerImpl {
+	root, err := ioutil.TempDir("", "camus-server-")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	s, err := NewServerImpl(root, false, 9500)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatalf("new server: %s", err)
+	}
+	t.Cleanup(func() {
+		s.stopAllRunners()
+		// they forget their processes' records as they finish
+		s.supervisors.Wait()
+		os.RemoveAll(root)
+	})
+	return s
+}
+
+// writeTestDeploy creates the deploy's dir on the server, with config as
+// its deploy.json.
+func writeTestDeploy(t *testing.T, s *ServerImpl, deployId string, config string) {
+	if err := os.MkdirAll(s.deployDir(deployId), 0755); err != nil {
+		t.Fatalf("create deploy dir: %s", err)
+	}
+	if err := ioutil.WriteFile(s.deployConfigFile(deployId), []byte(config), 0644); err != nil {
+		t.Fatalf("write deploy.json: %s", err)
+	}
+}
+
+func TestPersistActiveDeploy(t *testing.T) {
+	s := newTestServer(t)
+
+	s.config.Ports[9501] = "happy-paris-2026-01-01-00-00-00"
+	if err := s.setActive("happy-paris-2026-01-01-00-00-00"); err != nil {
+		t.Fatalf("set active: %s", err)
+	}
+	config, err := readConfig(path.Join(s.root, serverConfigFileName))
+	if err != nil {
+		t.Fatalf("read config: %s", err)
+	}
+	if config.Active != "happy-paris-2026-01-01-00-00-00" {
+		t.Errorf("expected the active deploy in config.json, got %q", config.Active)
+	}
+	if !s.isSet("happy-paris-2026-01-01-00-00-00", 0, -1) || s.isSet("other", 9502, 9502) {
+		t.Errorf("expected the recorded active deploy to be set, not haproxy's")
+	}
+}
+
+func TestStalePidIsNotHaproxy(t *testing.T) {
+	if haproxyAlive(os.Getpid()) {
+		t.Errorf("expected the test process not to be taken for haproxy")
+	}
+}
+
+func TestServerRootIsLocked(t *testing.T) {
+	s := newTestServer(t)
+
+	if _, err := NewServerImpl(s.root, false, 9600); err == nil ||
+		!strings.Contains(err.Error(), "Another camus server") {
+		t.Errorf("expected a second server on the same root to fail, got %v", err)
+	}
+
+	s.rootLock.Close()
+	if _, err := NewServerImpl(s.root, false, 9600); err != nil {
+		t.Errorf("expected the root to be free once the lock is released, got %s", err)
+	}
+}
+
+func TestConcurrentConfigChanges(t *testing.T) {
+	s := newTestServer(t)
+
+	ids := []string{}
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("happy-paris-2026-01-01-00-00-%02d", i)
+		os.MkdirAll(s.deployDir(id), 0755)
+		ids = append(ids, id)
+	}
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := s.Pin(id, true); err != nil {
+				t.Errorf("pin: %s", err)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	config, err := readConfig(path.Join(s.root, serverConfigFileName))
+	if err != nil {
+		t.Fatalf("read config: %s", err)
+	}
+	if len(config.Pinned) != len(ids) {
+		t.Errorf("expected all %d deploys pinned, got %v", len(ids), config.Pinned)
+	}
+	files, _ := filepath.Glob(path.Join(s.root, "."+serverConfigFileName+"*"))
+	if len(files) != 0 {
+		t.Errorf("expected no temporary files left, got %v", files)
+	}
+}
+
+func TestConcurrentRunDoesntBlockServer(t *testing.T) {
+	s := newTestServer(t)
+
+	deployId := "happy-paris-2026-01-01-00-00-00"
+	writeTestDeploy(t, s, deployId, `{
+		"RunCmd": "sleep 30 # %PORT%",
+		"HealthCheck": {"Type": "exec", "Cmd": "test -f healthy", "Interval": "50ms"}
+	}`)
+
+	ran := make(chan error)
+	go func() {
+		_, err := s.Run(deployId)
+		ran <- err
+	}()
+	// wait for it to start starting up
+	for s.runner(deployId) == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	listed := make(chan error)
+	go func() {
+		_, err := s.ListDeploys()
+		listed <- err
+	}()
+	select {
+	case err := <-listed:
+		if err != nil {
+			t.Errorf("list: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected listing deploys not to wait for the deploy to start up")
+	}
+	if _, err := s.Stop(deployId, true); err == nil || !strings.Contains(err.Error(), "being changed") {
+		t.Errorf("expected stopping a deploy while it's being run to be refused, got %v", err)
+	}
+
+	ioutil.WriteFile(path.Join(s.deployDir(deployId), "healthy"), nil, 0644)
+	if err := <-ran; err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if _, err := s.Stop(deployId, true); err != nil {
+		t.Errorf("stop: %s", err)
+	}
+}
+
+func TestNoRunAfterShutdown(t *testing.T) {
+	s := newTestServer(t)
+	deployId := "happy-paris-2026-01-01-00-00-00"
+	writeTestDeploy(t, s, deployId, `{"RunCmd": "sleep 30 # %PORT%"}`)
+
+	// as by Shutdown, while a run is past claiming its port
+	s.shuttingDown = true
+	if _, err := s.Run(deployId); err == nil || !strings.Contains(err.Error(), "shutting down") {
+		t.Errorf("expected the run to be refused, got %v", err)
+	}
+	if keys := s.runnerKeys(""); len(keys) != 0 {
+		t.Errorf("expected no runners, got %v", keys)
+	}
+}
+
+func TestListDeploysConfigAndMeta(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("no python3 to listen on the deploy's port")
+	}
+	s := newTestServer(t)
+	deployId := "happy-paris-2026-01-01-00-00-00"
+	writeTestDeploy(t, s, deployId, `{
+		"RunCmd": "python3 -m http.server %PORT% --bind 127.0.0.1",
+		"Env": {"DB_URL": "postgres://db", "CACHE": "on"},
+		"HealthCheck": {"Type": "tcp"}
+	}`)
+	pushed := time.Date(2026, 2, 3, 4, 5, 6, 0, time.UTC)
+	writeDeployMeta(s.deployDir(deployId), &DeployMeta{User: "alice", Pushed: pushed})
+	if _, err := s.Run(deployId); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	deploys, err := s.ListDeploys()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	var deploy *Deploy
+	for _, d := range deploys {
+		if d.Id == deployId {
+			deploy = d
+		}
+	}
+	if deploy == nil {
+		t.Fatalf("expected %s listed, got %v", deployId, deploys)
+	}
+	if strings.Join(deploy.EnvKeys, ",") != "CACHE,DB_URL" {
+		t.Errorf("expected the Env keys, got %v", deploy.EnvKeys)
+	}
+	if deploy.Meta == nil || deploy.Meta.User != "alice" || !deploy.Created.Equal(pushed) {
+		t.Errorf("expected it pushed by alice at %s, got %+v, %s", pushed, deploy.Meta, deploy.Created)
+	}
+	if deploy.Health != nonHttpHealthyStatus || len(deploy.Errors) != 0 {
+		t.Errorf("expected it healthy, got %d %v", deploy.Health, deploy.Errors)
+	}
+}
+
+func TestProcessesRunListAndStop(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("no python3 to listen on the deploy's ports")
+	}
+	s := newTestServer(t)
+	deployId := "happy-paris-2026-01-01-00-00-00"
+	writeTestDeploy(t, s, deployId, `{
+		"RunCmd": "python3 -m http.server %PORT% --bind 127.0.0.1",
+		"HealthCheck": {"Type": "tcp"},
+		"Processes": {
+			"admin": {"RunCmd": "python3 -m http.server %PORT% --bind 127.0.0.1", "Port": true},
+			"worker": {"RunCmd": "sleep 30"}
+		}
+	}`)
+
+	port, err := s.Run(deployId)
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	adminPort := s.config.ProcessPorts[deployId]["admin"]
+	if adminPort == 0 || adminPort == port {
+		t.Fatalf("expected admin to get its own port, got %d (main on %d)", adminPort, port)
+	}
+
+	deploys, err := s.ListDeploys()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	var deploy *Deploy
+	for _, d := range deploys {
+		if d.Id == deployId {
+			deploy = d
+		}
+	}
+	if deploy == nil || deploy.Port != port || deploy.Status != "Running" {
+		t.Fatalf("expected %s running on %d, got %+v", deployId, port, deploy)
+	}
+	if len(deploy.Processes) != 2 {
+		t.Fatalf("expected admin and worker listed, got %v", deploy.Processes)
+	}
+	pids := []int{deploy.Pid}
+	for _, p := range deploy.Processes {
+		expectedPort := map[string]int{"admin": adminPort, "worker": 0}[p.Name]
+		if p.Pid == 0 || p.Port != expectedPort || p.Status != "Running" {
+			t.Errorf("expected %s running on port %d, got %+v", p.Name, expectedPort, p)
+		}
+		pids = append(pids, p.Pid)
+	}
+
+	results, err := s.Stop(deployId, true)
+	if err != nil {
+		t.Fatalf("stop: %s", err)
+	}
+	stopped := []string{}
+	for _, result := range results {
+		if result.How == stopNotRunning {
+			t.Errorf("expected %q to have been running", result.Process)
+		}
+		stopped = append(stopped, result.Process)
+	}
+	if strings.Join(stopped, ",") != ",admin,worker" {
+		t.Errorf("expected the main process, admin and worker stopped, got %q", stopped)
+	}
+	for _, pid := range pids {
+		// orphans left as zombies don't count, there may be no init to reap them
+		if state, _, err := procState(strconv.Itoa(pid)); err == nil && state != "Z" {
+			t.Errorf("expected process %d to have been stopped", pid)
+		}
+	}
+	if s.lookupConfiguredPort(deployId) != 0 || s.config.ProcessPorts[deployId] != nil {
+		t.Errorf("expected the deploy's ports to be released")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// The server records each process it starts in state.json in its root, so
+// that it knows which processes are its deploys' even when their cwd isn't
+// the deploy dir, and after it has itself been restarted. As pids are
+// reused, a record only counts while the process with its pid has the same
+// start time. Each process is started in its own session, so for as long as
+// the recorded process runs, whatever it starts is recognised by its
+// session, even once it's left the process group and its parent has exited
+// (e.g. daemons). Daemons that start their own session are recognised by
+// the deploy's cgroup, if it has one (see Limits), or else by their
+// parents while they run. Guessing from a process's cwd is left for
+// processes the server didn't start.
+
+const serverStateFileName = "state.json"
+
+// ProcessRecord is what the server knows about a process it started.
+type ProcessRecord struct {
+	DeployId string
+
+	// "" for the deploy's main RunCmd, else the name of one of its Processes
+	Process string
+
+	Pid  int
+	Pgid int
+
+	// The process's session, 0 if it's the server's
+	Sid int `json:",omitempty"`
+
+	// The deploy's cgroup (see deployCgroup), "" if it runs in the server's
+	Cgroup string `json:",omitempty"`
+
+	// In clock ticks since boot, 0 if unknown (no /proc)
+	StartTime uint64
+
+	Port int
+}
+
+// alive is true if the recorded process is still running, and not some
+// other process that has since been given its pid.
+func (r *ProcessRecord) alive() bool {
+	if !processAlive(r.Pid) {
+		return false
+	}
+	if r.StartTime == 0 {
+		return true
+	}
+	startTime, err := procStartTime(r.Pid)
+	return err == nil && startTime == r.StartTime
+}
+
+// readState reads the records in file, keyed by runnerKey, dropping those
+// whose processes have gone.
+func readState(file string) (map[string]*ProcessRecord, error) {
+	state := map[string]*ProcessRecord{}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	for key, r := range state {
+		if !r.alive() {
+			delete(state, key)
+		}
+	}
+	return state, nil
+}
+
+// writeState writes the records, the caller holds stateLock.
+func (s *ServerImpl) writeState() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(s.root, serverStateFileName),
+		data, os.FileMode(0644))
+}
+
+// recordProcess records that the server started pid for the deploy.
+func (s *ServerImpl) recordProcess(deployId string, process string, pid int, port int) {
+	r := &ProcessRecord{
+		DeployId: deployId,
+		Process:  process,
+		Pid:      pid,
+		Pgid:     pid,
+		Port:     port,
+	}
+	if pgid, err := syscall.Getpgid(pid); err == nil {
+		r.Pgid = pgid
+	}
+	if sid, err := procSession(pid); err == nil && sid != s.ownSession() {
+		r.Sid = sid
+	}
+	if cgroup, err := procCgroup(pid); err == nil && cgroup != s.ownCgroup() {
+		r.Cgroup = cgroup
+	}
+	if startTime, err := procStartTime(pid); err == nil {
+		r.StartTime = startTime
+	}
+
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	s.state[runnerKey(deployId, process)] = r
+	if err := s.writeState(); err != nil {
+		log.Printf("record %s: %s\n", runnerKey(deployId, process), err)
+	}
+}
+
+// forgetProcess drops the record for key, once its process pid has been
+// stopped (it may have been restarted with another pid since).
+func (s *ServerImpl) forgetProcess(key string, pid int) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	if r, ok := s.state[key]; !ok || r.Pid != pid {
+		return
+	}
+	delete(s.state, key)
+	if err := s.writeState(); err != nil {
+		log.Printf("forget %s: %s\n", key, err)
+	}
+}
+
+// liveRecord returns the record for key if its process is still running,
+// else nil.
+func (s *ServerImpl) liveRecord(key string) *ProcessRecord {
+	s.stateLock.Lock()
+	r := s.state[key]
+	s.stateLock.Unlock()
+	if r == nil || !r.alive() {
+		return nil
+	}
+	return r
+}
+
+// recordedKeys returns the keys of all records starting with prefix.
+func (s *ServerImpl) recordedKeys(prefix string) []string {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	keys := []string{}
+	for key := range s.state {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// recordedOwner returns the record of the process the server started that
+// pid is, is in the process group, session or cgroup of, or is descended
+// from, or nil if there isn't one.
+func (s *ServerImpl) recordedOwner(pid int) *ProcessRecord {
+	pgid, err := syscall.Getpgid(pid)
+	if err != nil {
+		return nil
+	}
+	sid, _ := procSession(pid)
+	cgroup, _ := procCgroup(pid)
+	ancestors := procAncestors(pid)
+	s.stateLock.Lock()
+	records := []*ProcessRecord{}
+	for _, r := range s.state {
+		if r.Pid == pid || r.Pgid == pgid || r.Sid != 0 && r.Sid == sid ||
+			r.Cgroup != "" && r.Cgroup == cgroup || ancestors[r.Pid] {
+			records = append(records, r)
+		}
+	}
+	s.stateLock.Unlock()
+
+	for _, r := range records {
+		if r.alive() {
+			return r
+		}
+	}
+	return nil
+}
+
+// findListeningProcesses returns the processes listening on the server's
+// ports, identifying the deploys of those it started from its records.
+func (s *ServerImpl) findListeningProcesses() []Process {
+	procs := FindListeningProcesses(s.startPort, s.endPort)
+	for i := range procs {
+		if r := s.recordedOwner(procs[i].Pid); r != nil {
+			procs[i].DeployId = r.DeployId
+		}
+	}
+	return procs
+}
+
+// ownSession returns the server's own session, which the processes it
+// starts leave (see detachProc).
+func (s *ServerImpl) ownSession() int {
+	sid, _ := procSession(os.Getpid())
+	return sid
+}
+
+// ownCgroup returns the server's own cgroup, which the processes it starts
+// are in unless their deploy has one.
+func (s *ServerImpl) ownCgroup() string {
+	cgroup, _ := procCgroup(os.Getpid())
+	return cgroup
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestProcessRecords(t *testing.T) {
+	s := newTestServer(t)
+
+	// a deploy, and a child of it that has left its dir
+	leader := exec.Command("sleep", "10")
+	leader.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := leader.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	defer leader.Process.Kill()
+	child := exec.Command("sleep", "10")
+	child.Dir = "/"
+	child.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: leader.Process.Pid}
+	if err := child.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	defer child.Process.Kill()
+
+	s.recordProcess("happy-paris-2026-01-01-00-00-00", "", leader.Process.Pid, 9501)
+	if r := s.recordedOwner(child.Process.Pid); r == nil || r.DeployId != "happy-paris-2026-01-01-00-00-00" {
+		t.Errorf("expected the child to be found by its process group, got %v", r)
+	}
+
+	// as read by the next server
+	state, err := readState(path.Join(s.root, serverStateFileName))
+	if err != nil || state["happy-paris-2026-01-01-00-00-00"] == nil {
+		t.Fatalf("expected the record to be kept, got %v, %v", state, err)
+	}
+
+	// the pid has been reused
+	if _, err := os.Stat("/proc/self/stat"); err == nil {
+		s.state["happy-paris-2026-01-01-00-00-00"].StartTime++
+		if s.liveRecord("happy-paris-2026-01-01-00-00-00") != nil {
+			t.Errorf("expected a record with another start time not to count")
+		}
+		s.state["happy-paris-2026-01-01-00-00-00"].StartTime--
+	}
+
+	leader.Process.Kill()
+	leader.Wait()
+	if s.liveRecord("happy-paris-2026-01-01-00-00-00") != nil {
+		t.Errorf("expected the record of an exited process not to count")
+	}
+	state, err = readState(path.Join(s.root, serverStateFileName))
+	if err != nil || len(state) != 0 {
+		t.Errorf("expected the record to be dropped, got %v, %v", state, err)
+	}
+}
+
+func TestRecordedOwnerOfDaemon(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("no python3 to daemonize with")
+	}
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc")
+	}
+	s := newTestServer(t)
+
+	// a deploy that daemonizes a child: it leaves the deploy's process
+	// group and dir, and its parent exits
+	deploy := exec.Command("sh", "-c", `python3 -c '
+import os, time
+if os.fork() == 0:
+    os.setpgid(0, 0)
+    os.chdir("/")
+    print(os.getpid(), flush=True)
+    time.sleep(10)
+'; exec sleep 10`)
+	detachProc(deploy)
+	stdout, _ := deploy.StdoutPipe()
+	if err := deploy.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	defer syscall.Kill(-deploy.Process.Pid, syscall.SIGKILL)
+	var daemon int
+	if _, err := fmt.Fscan(stdout, &daemon); err != nil {
+		t.Fatalf("read daemon pid: %s", err)
+	}
+	defer syscall.Kill(daemon, syscall.SIGKILL)
+	for i := 0; procAncestors(daemon)[deploy.Process.Pid]; i++ {
+		if i == 100 {
+			t.Fatalf("expected the daemon's parent to exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pgid, _ := syscall.Getpgid(daemon); pgid == deploy.Process.Pid {
+		t.Fatalf("expected the daemon to have left the deploy's process group")
+	}
+
+	s.recordProcess("happy-paris-2026-01-01-00-00-00", "", deploy.Process.Pid, 9501)
+	if r := s.recordedOwner(daemon); r == nil || r.DeployId != "happy-paris-2026-01-01-00-00-00" {
+		t.Errorf("expected the daemon to be found by its session, got %v", r)
+	}
+	if r := s.recordedOwner(os.Getpid()); r != nil {
+		t.Errorf("expected the server not to be taken for the deploy, got %v", r)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Processes are stopped gracefully: SIGTERM goes to the whole process group,
+// so any children get it too, then camus waits up to the app's StopTimeout
+// for the group to exit before sending it SIGKILL.
+
+const (
+	defaultStopTimeout = 10 * time.Second
+
+	// How often to check whether a process group has exited.
+	stopPollInterval = 50 * time.Millisecond
+)
+
+// How a process ended when it was stopped, see StopResult.How
+const (
+	stopExited     = "exited"
+	stopKilled     = "killed"
+	stopNotRunning = "not running"
+)
+
+// StopResult describes how a process ended when it was stopped.
+type StopResult struct {
+	// "" for a deploy's main RunCmd, else the name of one of its Processes
+	Process string
+
+	Pid int
+
+	// "exited" if the process group exited after SIGTERM, "killed" if it
+	// had to be sent SIGKILL after StopTimeout, or "not running"
+	How string
+
+	// How the process itself ended, e.g. "exit status 0", if known
+	ExitStatus string
+
+	// From SIGTERM until the process group was gone
+	Took time.Duration
+}
+
+func (r *StopResult) String() string {
+	name := "app"
+	if r.Process != "" {
+		name = r.Process
+	}
+	return name + ": " + r.summary()
+}
+
+// summary describes how the process ended, without saying which it was.
+func (r *StopResult) summary() string {
+	if r.How == stopNotRunning {
+		return r.How
+	}
+	msg := fmt.Sprintf("pid %d %s after %s", r.Pid, r.How,
+		r.Took.Round(time.Millisecond))
+	if r.ExitStatus != "" {
+		msg += fmt.Sprintf(" (%s)", r.ExitStatus)
+	}
+	return msg
+}
+
+// stopProcessGroup stops pid along with the rest of its process group. If
+// pid is our child, exited receives its state when it exits (and must, as
+// it's how it gets reaped), otherwise exited is nil.
+func stopProcessGroup(pid int, timeout time.Duration, exited <-chan *os.ProcessState) *StopResult {
+	result := &StopResult{Pid: pid, How: stopExited}
+	start := time.Now()
+
+	// Signal the whole group, unless it's somehow ours.
+	target := pid
+	if pgid, err := syscall.Getpgid(pid); err == nil && pgid != syscall.Getpgrp() {
+		target = -pgid
+	}
+
+	if err := syscall.Kill(target, syscall.SIGTERM); err == syscall.ESRCH {
+		result.How = stopNotRunning
+		if exited != nil {
+			result.ExitStatus = (<-exited).String()
+		}
+		return result
+	}
+
+	deadline := start.Add(timeout)
+	if exited != nil {
+		select {
+		case state := <-exited:
+			result.ExitStatus = state.String()
+			exited = nil
+		case <-time.After(timeout):
+		}
+	}
+	for signalable(target) && time.Now().Before(deadline) {
+		time.Sleep(stopPollInterval)
+	}
+
+	if signalable(target) {
+		result.How = stopKilled
+		syscall.Kill(target, syscall.SIGKILL)
+		if exited != nil {
+			result.ExitStatus = (<-exited).String()
+		}
+		for i := 0; signalable(target) && i < 20; i++ {
+			time.Sleep(stopPollInterval)
+		}
+	}
+	result.Took = time.Since(start)
+	return result
+}
+
+// stopPids stops each of pids, which aren't our children, in parallel.
+func stopPids(pids []int, timeout time.Duration) []*StopResult {
+	results := make([]*StopResult, len(pids))
+	var wg sync.WaitGroup
+	for i, pid := range pids {
+		wg.Add(1)
+		go func(i int, pid int) {
+			defer wg.Done()
+			results[i] = stopProcessGroup(pid, timeout, nil)
+		}(i, pid)
+	}
+	wg.Wait()
+	return results
+}
+
+// signalable is true if target (a pid, or minus a process group id) still
+// has a process. Zombies don't count, orphaned ones can take a while to be
+// reaped.
+func signalable(target int) bool {
+	if err := syscall.Kill(target, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	pids := []string{strconv.Itoa(target)}
+	if target < 0 {
+		var err error
+		if pids, err = procPids("/proc"); err != nil {
+			return true
+		}
+	}
+	for _, pid := range pids {
+		state, pgid, err := procState(pid)
+		if err != nil {
+			if target > 0 && !os.IsNotExist(err) {
+				// no /proc, trust kill
+				return true
+			}
+			continue
+		}
+		if (target > 0 || pgid == -target) && state != "Z" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// startGroup starts cmd in its own process group, returning a channel that
+// receives its state when it exits.
+func startGroup(t *testing.T, cmd string) (int, chan *os.ProcessState) {
+	c := exec.Command("sh", "-c", cmd)
+	detachProc(c)
+	if err := c.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	exited := make(chan *os.ProcessState, 1)
+	go func() {
+		c.Wait()
+		exited <- c.ProcessState
+	}()
+	// give the shell a moment to set up its traps
+	time.Sleep(200 * time.Millisecond)
+	return c.Process.Pid, exited
+}
+
+func TestStopProcessGroup(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  string
+		how  string
+	}{
+		{"exits on SIGTERM", "sleep 30", stopExited},
+		{"ignores SIGTERM", "trap '' TERM; sleep 30 & wait; sleep 30", stopKilled},
+		// the shell exits, but a child left in the group doesn't
+		{"child ignores SIGTERM", "(trap '' TERM; sleep 30) & wait", stopKilled},
+	}
+
+	for _, test := range tests {
+		pid, exited := startGroup(t, test.cmd)
+		result := stopProcessGroup(pid, 500*time.Millisecond, exited)
+		if result.How != test.how {
+			t.Errorf("%s: expected %s, got %s", test.name, test.how, result)
+		}
+		if result.ExitStatus == "" {
+			t.Errorf("%s: expected an exit status, got %s", test.name, result)
+		}
+		if signalable(-pid) {
+			t.Errorf("%s: process group %d is still running", test.name, pid)
+		}
+		if result.How == stopExited && result.Took >= 500*time.Millisecond {
+			t.Errorf("%s: expected it to stop before the timeout, took %s", test.name, result.Took)
+		}
+	}
+}
+
+func TestStopNotRunning(t *testing.T) {
+	pid, exited := startGroup(t, "exit 0")
+	state := <-exited
+	done := make(chan *os.ProcessState, 1)
+	done <- state
+
+	result := stopProcessGroup(pid, time.Second, done)
+	if result.How != stopNotRunning {
+		t.Errorf("expected %s, got %s", stopNotRunning, result)
+	}
+}
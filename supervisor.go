@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Deploys started by the server are supervised by a Runner, one for the
+// deploy's main RunCmd and one for each of its additional processes. The
+// runner notices as soon as its process exits and restarts it. Enforce only
+// falls back to looking at what's listening on the ports for deploys without
+// a runner, e.g. ones left running by a previous server.
+
+// runnerKey identifies the runner of a deploy's process, "" for the main one.
+func runnerKey(deployId string, process string) string {
+	if process == "" {
+		return deployId
+	}
+	return deployId + "/" + process
+}
+
+// runner returns the runner for key, or nil if there isn't one.
+func (s *ServerImpl) runner(key string) *Runner {
+	s.runnersLock.Lock()
+	defer s.runnersLock.Unlock()
+	return s.runners[key]
+}
+
+// supervise starts r's RunLoop, registered under key until it returns. It
+// refuses once the server is shutting down, so nothing outlives it.
+func (s *ServerImpl) supervise(key string, r *Runner) error {
+	s.runnersLock.Lock()
+	if s.shuttingDown {
+		s.runnersLock.Unlock()
+		return fmt.Errorf("The server is shutting down")
+	}
+	s.runners[key] = r
+	s.runnersLock.Unlock()
+
+	s.supervisors.Add(1)
+	go func() {
+		defer s.supervisors.Done()
+		r.RunLoop()
+		s.forgetRunner(key, r)
+		s.forgetProcess(key, int(atomic.LoadInt32(&r.Pid)))
+	}()
+	return nil
+}
+
+func (s *ServerImpl) forgetRunner(key string, r *Runner) {
+	s.runnersLock.Lock()
+	defer s.runnersLock.Unlock()
+	if s.runners[key] == r {
+		delete(s.runners, key)
+	}
+}
+
+// supervised is true if any of the deploy's processes have a runner.
+func (s *ServerImpl) supervised(deployId string) bool {
+	return s.runner(runnerKey(deployId, "")) != nil ||
+		len(s.runnerKeys(runnerKey(deployId, "")+"/")) > 0
+}
+
+// stopRunner stops the process supervised under key, returning nil if
+// there is no runner for it.
+func (s *ServerImpl) stopRunner(key string) *StopResult {
+	r := s.runner(key)
+	if r == nil {
+		return nil
+	}
+	result := r.Stop()
+	s.forgetRunner(key, r)
+	return result
+}
+
+// runnerKeys returns the keys of all runners starting with prefix.
+func (s *ServerImpl) runnerKeys(prefix string) []string {
+	s.runnersLock.Lock()
+	defer s.runnersLock.Unlock()
+	keys := []string{}
+	for key := range s.runners {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// stopAllRunners stops every supervised process, in parallel.
+func (s *ServerImpl) stopAllRunners() {
+	keys := s.runnerKeys("")
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			s.stopRunner(key)
+		}(key)
+	}
+	wg.Wait()
+}
+
+// superviseDeploy starts a runner for the deploy's main RunCmd on port, and
+// waits for it to start up.
+func (s *ServerImpl) superviseDeploy(deployId string, app Application, port int) error {
+	vars := s.runVars(deployId, app, port)
+	cmd, err := app.RunCmd(vars)
+	if err != nil {
+		return err
+	}
+	r := NewRunner(vars.DeployDir, cmd, app.HealthCheck(vars.Target).Expand(vars), port)
+	r.Env = s.appEnv(app, vars)
+	r.Health.Env = r.Env
+	r.Output = newRotatingLog(s.logFile(deployId, ""), app.LogPolicy())
+	r.StopTimeout = app.StopTimeout()
+	s.applyLimits(r, deployId, app.Limits())
+	if err := s.runAs(r, app, vars); err != nil {
+		return err
+	}
+	r.OnStart = func(pid int) {
+		s.recordProcess(deployId, "", pid, port)
+	}
+	if err := s.supervise(runnerKey(deployId, ""), r); err != nil {
+		return err
+	}
+	return r.WaitForStartup()
+}
+
+// appEnv returns the environment to run one of the deploy's processes with.
+func (s *ServerImpl) appEnv(app Application, vars RunVars) []string {
+	env := os.Environ()
+	if vars.Port != 0 {
+		env = append(env, fmt.Sprintf("PORT=%d", vars.Port))
+	}
+	for key, value := range app.Env(vars.Target) {
+		env = append(env, key+"="+value)
+	}
+	return env
+}
+
+// runnerStatus returns the status of the runner for key, "" if it isn't
+// supervised, along with why if it's in error or crash looping. The caller
+// holds s.lock, at least for reading.
+func (s *ServerImpl) runnerStatus(key string) (string, []string) {
+	var errs []string
+	if b, ok := s.startFailures[key]; ok && b.crashLooping() {
+		errs = append(errs, b.String())
+	}
+	r := s.runner(key)
+	if r == nil {
+		return "", errs
+	}
+	status := r.Status()
+	if status == Error && r.Err() != nil {
+		errs = append(errs, r.Err().Error())
+	}
+	errs = append(errs, r.Warnings...)
+	if crashLoop := r.CrashLoop(); crashLoop != "" {
+		errs = append(errs, crashLoop)
+	}
+	return status.String(), errs
+}
@@ -6,27 +6,64 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type TerminalClient struct {
-	flags    *flag.FlagSet
-	client   Client
-	commands map[string]Command
+	flags       *flag.FlagSet
+	deployFile  string
+	targetName  TargetName
+	isLocalTest bool
+	client      Client
+	connect     func() (Client, error)
+	commands    map[string]Command
+
+	// commands that don't need a connection to a server
+	offline map[string]bool
 }
 
 type Command func() error
 
-func NewTerminalClient(flags *flag.FlagSet, client Client) *TerminalClient {
-	c := &TerminalClient{flags, client, make(map[string]Command)}
+// NewTerminalClient creates a terminal client for the given deploy file and
+// target. isLocalTest applies deploy.local.json (see config_layers.go).
+// connect is only called for commands that need to talk to a server.
+func NewTerminalClient(
+	flags *flag.FlagSet,
+	deployFile string,
+	targetName TargetName,
+	isLocalTest bool,
+	connect func() (Client, error)) *TerminalClient {
+
+	c := &TerminalClient{
+		flags:       flags,
+		deployFile:  deployFile,
+		targetName:  targetName,
+		isLocalTest: isLocalTest,
+		connect:     connect,
+		commands:    make(map[string]Command),
+		offline:     make(map[string]bool),
+	}
 	c.commands["deploy"] = c.deployCmd
 	c.commands["run"] = c.runCmd
 	c.commands["list"] = c.listCmd
 	c.commands["set"] = c.setCmd
 	c.commands["help"] = c.helpCmd
 	c.commands["stop"] = c.stopCmd
+	c.commands["logs"] = c.logsCmd
+	c.commands["prune"] = c.pruneCmd
+	c.commands["pin"] = c.pinCmd
+	c.commands["unpin"] = c.unpinCmd
+	c.commands["history"] = c.historyCmd
 	// TODO(koz): Consider not exposing these in the terminal client.
 	c.commands["cleanup"] = c.cleanupCmd
 	c.commands["shutdown"] = c.shutdownCmd
+	c.commands["validate"] = c.validateCmd
+	c.commands["config"] = c.configCmd
+
+	c.offline["help"] = true
+	c.offline["validate"] = true
+	c.offline["config"] = true
 	return c
 }
 
@@ -41,6 +78,13 @@ func (c *TerminalClient) Run() error {
 		c.helpCmd()
 		return nil
 	}
+	if !c.offline[cmdName] && c.client == nil {
+		client, err := c.connect()
+		if err != nil {
+			return fmt.Errorf("NewClient: %s", err)
+		}
+		c.client = client
+	}
 	return cmd()
 }
 
@@ -116,23 +160,171 @@ func (ds ByDeployId) Len() int           { return len(ds) }
 func (ds ByDeployId) Swap(i, j int)      { ds[i], ds[j] = ds[j], ds[i] }
 func (ds ByDeployId) Less(i, j int) bool { return ds[i].Id < ds[j].Id }
 
+// ByAge sorts deploys newest first. A deploy listed by several servers
+// should be given the same Created on each, to keep them together.
+type ByAge []*Deploy
+
+func (ds ByAge) Len() int      { return len(ds) }
+func (ds ByAge) Swap(i, j int) { ds[i], ds[j] = ds[j], ds[i] }
+func (ds ByAge) Less(i, j int) bool {
+	if !ds[i].Created.Equal(ds[j].Created) {
+		return ds[i].Created.After(ds[j].Created)
+	}
+	return ds[i].Id < ds[j].Id
+}
+
+// States deploys can be filtered by in 'camus list'
+var listStates = []string{"running", "tracked", "active", "errored", "pinned"}
+
+// deployInState is true if the deploy is in the state, one of listStates.
+func deployInState(d *Deploy, state string) bool {
+	switch state {
+	case "running":
+		if d.Pid != 0 {
+			return true
+		}
+		for _, p := range d.Processes {
+			if p.Pid != 0 {
+				return true
+			}
+		}
+		return false
+	case "tracked":
+		return d.Tracked
+	case "active":
+		return d.Set
+	case "errored":
+		if len(d.Errors) > 0 || d.Status == Error.String() {
+			return true
+		}
+		for _, p := range d.Processes {
+			if len(p.Errors) > 0 || p.Status == Error.String() {
+				return true
+			}
+		}
+		return false
+	case "pinned":
+		return d.Pinned
+	}
+	return false
+}
+
+// filterDeploys returns the deploys in all the states pushed to target
+// ("" for any), newest first, keeping the latest n of them (0 for all).
+// Listings of the same deploy from different servers count as one.
+func filterDeploys(deploys []*Deploy, states []string, target TargetName, n int) []*Deploy {
+	created := map[string]time.Time{}
+	for _, d := range deploys {
+		if t, ok := created[d.Id]; !ok || d.Created.Before(t) {
+			created[d.Id] = d.Created
+		}
+	}
+	for _, d := range deploys {
+		d.Created = created[d.Id]
+	}
+	sort.Sort(ByAge(deploys))
+
+	filtered := []*Deploy{}
+	ids, lastId := 0, ""
+	for _, d := range deploys {
+		if target != "" && d.Target != target {
+			continue
+		}
+		in := true
+		for _, state := range states {
+			in = in && deployInState(d, state)
+		}
+		if !in {
+			continue
+		}
+		if d.Id != lastId {
+			ids++
+			lastId = d.Id
+		}
+		if n > 0 && ids > n {
+			break
+		}
+		filtered = append(filtered, d)
+	}
+	return filtered
+}
+
+// relativeAge describes how long ago t was, e.g. "3h ago".
+func relativeAge(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	age := now.Sub(t)
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(age.Hours()/24))
+	}
+}
+
+// listCmd handles 'list [-v] [-sort age|id] [-state states] [-for target]
+// [-n count]', printing the server's deploys, newest first. With -v it
+// also prints where each came from.
 func (c *TerminalClient) listCmd() error {
+	usage := "usage: camus list [-v] [-sort age|id] [-state " +
+		strings.Join(listStates, ",") + "] [-for target] [-n count]"
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "show where each deploy came from")
+	sortBy := flags.String("sort", "age", "sort by age (newest first) or id")
+	stateList := flags.String("state", "",
+		"only list deploys in all these states: "+strings.Join(listStates, ", "))
+	target := flags.String("for", "", "only list deploys pushed to this target")
+	n := flags.Int("n", 0, "only list the latest n deploys")
+	if err := flags.Parse(c.flags.Args()[1:]); err != nil {
+		return err
+	}
+	if *sortBy != "age" && *sortBy != "id" {
+		return fmt.Errorf("Unknown sort %s\n%s", *sortBy, usage)
+	}
+	states := []string{}
+	if *stateList != "" {
+		states = strings.Split(*stateList, ",")
+	}
+	for _, state := range states {
+		if !contains(listStates, state) {
+			return fmt.Errorf("Unknown state %s\n%s", state, usage)
+		}
+	}
+	if *n < 0 {
+		return fmt.Errorf("-n should be positive\n%s", usage)
+	}
+
 	deploys, err := c.client.ListDeploys()
 	if err != nil {
 		return err
 	}
 
-	sort.Sort(ByDeployId(deploys))
+	deploys = filterDeploys(deploys, states, TargetName(*target), *n)
+	if *sortBy == "id" {
+		sort.Stable(ByDeployId(deploys))
+	}
+	now := time.Now()
 
 	fmt.Printf("Deploys:\n")
 
 	tbl := TableDef{
 		Columns: []ColumnDef{
 			ColumnDef{"   id", 45},
+			ColumnDef{"age", 8},
 			ColumnDef{"pid", 5},
 			ColumnDef{"tracked", 7},
+			ColumnDef{"pin", 3},
+			ColumnDef{"commit", 9},
+			ColumnDef{"pushed by", 16},
 			ColumnDef{"port", 4},
 			ColumnDef{"st", 3},
+			ColumnDef{"status", 8},
+			ColumnDef{"env", 20},
 			ColumnDef{"messages", 50},
 		},
 	}
@@ -147,35 +339,317 @@ func (c *TerminalClient) listCmd() error {
 			id = ""
 		}
 
+		commit, pushedBy := "", ""
+		if d.Meta != nil {
+			commit, pushedBy = d.Meta.ShortCommit(), d.Meta.PushedBy()
+		}
 		tbl.PrintRow(
 			fmt.Sprintf("%s%s", activePointer(d.Set), id),
+			relativeAge(d.Created, now),
 			d.Pid,
 			yn(d.Tracked),
+			yn(d.Pinned),
+			commit,
+			pushedBy,
 			d.Port,
 			d.Health,
+			d.Status,
+			strings.Join(d.EnvKeys, ","),
 			fmt.Sprintf("%v", d.Errors),
 		)
+		if *verbose && d.Meta != nil {
+			fmt.Printf("     %s\n", d.Meta)
+		}
+
+		for _, p := range d.Processes {
+			tbl.PrintRow(
+				fmt.Sprintf("     - %s", p.Name),
+				"",
+				p.Pid,
+				"",
+				"",
+				"",
+				"",
+				p.Port,
+				p.Health,
+				p.Status,
+				"",
+				fmt.Sprintf("%v", p.Errors),
+			)
+		}
 
 		prevId = d.Id
 	}
 	return nil
 }
 
+// stopCmd handles 'stop [-force] <deploy>'. -force skips the deploy's
+// pre-stop hook, e.g. when it's failing.
 func (c *TerminalClient) stopCmd() error {
+	flags := flag.NewFlagSet("stop", flag.ContinueOnError)
+	force := flags.Bool("force", false, "don't run the deploy's pre-stop hook")
+	if err := flags.Parse(c.flags.Args()[1:]); err != nil {
+		return err
+	}
+	deployId := flags.Arg(0)
+	if deployId == "" {
+		return errors.New("Missing deploy id")
+	}
+	results, err := c.client.Stop(deployId, *force)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		fmt.Printf("stopped %s\n", result)
+	}
+	return nil
+}
+
+// logsCmd handles 'logs [-n lines] [-f] <deploy> [process]', printing the
+// end of the output of a deploy's RunCmd, or of one of its processes.
+func (c *TerminalClient) logsCmd() error {
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	lines := flags.Int("n", defaultLogLines, "number of lines to show")
+	follow := flags.Bool("f", false, "keep printing output as it is written")
+	if err := flags.Parse(c.flags.Args()[1:]); err != nil {
+		return err
+	}
+	deployId := flags.Arg(0)
+	if deployId == "" {
+		return errors.New("usage: camus logs [-n lines] [-f] <deploy> [process]")
+	}
+
+	req := LogsRequest{DeployId: deployId, Process: flags.Arg(1), Lines: *lines}
+	for {
+		reply, err := c.client.Logs(req)
+		if err != nil {
+			return err
+		}
+		fmt.Print(reply.Data)
+		if !*follow {
+			return nil
+		}
+
+		req.Follow = true
+		req.Inode = reply.Inode
+		req.Offset = reply.Offset
+		req.RotatedInode = reply.RotatedInode
+		if len(reply.Data) < maxLogsReplySize {
+			time.Sleep(logsFollowInterval)
+		}
+	}
+}
+
+// pruneCmd handles 'prune [-keep n] [-older-than duration] [-dry-run]',
+// removing old deploys from the server.
+func (c *TerminalClient) pruneCmd() error {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	keep := flags.Int("keep", 0, "keep the newest n deploys")
+	olderThan := flags.String("older-than", "",
+		"keep deploys newer than this, e.g. 720h")
+	dryRun := flags.Bool("dry-run", false, "only list what would be removed")
+	if err := flags.Parse(c.flags.Args()[1:]); err != nil {
+		return err
+	}
+
+	policy := RetentionPolicy{Keep: *keep, OlderThan: *olderThan}
+	if _, err := policy.maxAge(); err != nil {
+		return fmt.Errorf("%s\nusage: camus prune [-keep n] [-older-than duration] [-dry-run]", err)
+	}
+	decisions, err := c.client.Prune(policy, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Printf("Would prune (%s):\n", policy)
+	} else {
+		fmt.Printf("Pruned (%s):\n", policy)
+	}
+	tbl := TableDef{
+		Columns: []ColumnDef{
+			ColumnDef{"   id", 45},
+			ColumnDef{"created", 19},
+			ColumnDef{"action", 7},
+			ColumnDef{"reason", 40},
+		},
+	}
+	tbl.PrintHeader()
+	for _, d := range decisions {
+		action, reason := "keep", d.Reason
+		if d.Removed && *dryRun {
+			action = "remove"
+		} else if d.Removed {
+			action = "removed"
+		} else if d.Error != "" {
+			action, reason = "failed", d.Error
+		}
+		tbl.PrintRow(
+			"   "+d.Id,
+			d.Created.Local().Format("2006-01-02 15:04:05"),
+			action,
+			reason,
+		)
+	}
+	return nil
+}
+
+func (c *TerminalClient) pinCmd() error {
+	return c.setPinned(true)
+}
+
+func (c *TerminalClient) unpinCmd() error {
+	return c.setPinned(false)
+}
+
+// setPinned handles 'pin <deploy>' and 'unpin <deploy>'. Pinned deploys
+// are never pruned.
+func (c *TerminalClient) setPinned(pinned bool) error {
 	deployId := c.flags.Arg(1)
 	if deployId == "" {
 		return errors.New("Missing deploy id")
 	}
-	err := c.client.Stop(deployId)
+	return c.client.Pin(deployId, pinned)
+}
+
+// historyCmd handles 'history [-since time] [-until time] [-n count]
+// [deploy]', printing who changed what on the server and when.
+func (c *TerminalClient) historyCmd() error {
+	usage := "usage: camus history [-since time] [-until time] [-n count] [deploy]"
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	sinceStr := flags.String("since", "",
+		"only show changes since then, a time or a duration ago, e.g. 24h")
+	untilStr := flags.String("until", "", "only show changes until then")
+	n := flags.Int("n", 0, "only show the latest n changes")
+	if err := flags.Parse(c.flags.Args()[1:]); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	req := HistoryRequest{DeployId: flags.Arg(0)}
+	var err error
+	if req.Since, err = parseHistoryTime(*sinceStr, now); err != nil {
+		return fmt.Errorf("-since: %s\n%s", err, usage)
+	}
+	if req.Until, err = parseHistoryTime(*untilStr, now); err != nil {
+		return fmt.Errorf("-until: %s\n%s", err, usage)
+	}
+	entries, err := c.client.History(req)
+	if err != nil {
+		return err
+	}
+	if *n > 0 && len(entries) > *n {
+		entries = entries[len(entries)-*n:]
+	}
+
+	tbl := TableDef{
+		Columns: []ColumnDef{
+			ColumnDef{"time", 19},
+			ColumnDef{"target", 10},
+			ColumnDef{"who", 20},
+			ColumnDef{"action", 12},
+			ColumnDef{"deploy", 42},
+			ColumnDef{"detail", 40},
+		},
+	}
+	tbl.PrintHeader()
+	for _, entry := range entries {
+		details := []string{}
+		if entry.Detail != "" {
+			details = append(details, entry.Detail)
+		}
+		if entry.Port != 0 {
+			details = append(details, fmt.Sprintf("port %d", entry.Port))
+		}
+		if entry.Error != "" {
+			details = append(details, "failed: "+entry.Error)
+		}
+		tbl.PrintRow(
+			entry.Time.Local().Format("2006-01-02 15:04:05"),
+			string(entry.Target),
+			entry.Caller.String(),
+			entry.Action,
+			entry.DeployId,
+			strings.Join(details, ", "),
+		)
+	}
+	return nil
+}
+
+// parseHistoryTime parses s as a duration before now (e.g. 24h), or a time
+// (RFC 3339, or a local date with an optional time). "" is the zero time.
+func parseHistoryTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse %q as a time or duration", s)
+}
+
+func (c *TerminalClient) validateCmd() error {
+	file := c.flags.Arg(1)
+	if file == "" {
+		file = c.deployFile
+	}
+
+	problems, err := validateDeployFile(file, c.targetName, c.isLocalTest)
 	if err != nil {
 		return err
 	}
-	println("killed")
+
+	if len(problems) == 0 {
+		fmt.Printf("%s is valid\n", file)
+		return nil
+	}
+
+	fmt.Printf("%s has %d problem(s):\n", file, len(problems))
+	for _, problem := range problems {
+		fmt.Printf("  %s\n", problem)
+	}
+	return fmt.Errorf("Invalid %s", file)
+}
+
+// configCmd handles 'config show', which prints deploy.json merged with
+// its overlays for the target.
+func (c *TerminalClient) configCmd() error {
+	if c.flags.Arg(1) != "show" {
+		return errors.New("usage: camus [-cfg file] [-target name] config show")
+	}
+
+	data, layers, err := loadConfigLayers(c.deployFile, c.targetName, c.isLocalTest)
+	if err != nil {
+		return err
+	}
+	if _, err := applicationFromData(true, data); err != nil {
+		return err
+	}
+
+	fmt.Printf("# effective config for target '%s', from:\n", c.targetName)
+	for _, layer := range layers {
+		fmt.Printf("#   %s\n", layer)
+	}
+	fmt.Printf("%s\n", data)
 	return nil
 }
 
 func (c *TerminalClient) cleanupCmd() error {
-	c.client.KillUnknownProcesses()
+	results, err := c.client.KillUnknownProcesses()
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		fmt.Printf("stopped %s\n", result)
+	}
 	return nil
 }
 
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListFilterDeploys(t *testing.T) {
+	now := time.Date(2016, 5, 10, 12, 0, 0, 0, time.UTC)
+	deploy := func(id string, age time.Duration) *Deploy {
+		return &Deploy{Id: id, Created: now.Add(-age), Target: "prod"}
+	}
+	newest := deploy("happy-paris", time.Hour)
+	newest.Pid = 123
+	newest.Tracked = true
+	// the same deploy listed by another server, pushed a moment later
+	newestElsewhere := deploy("happy-paris", time.Hour-time.Second)
+	middle := deploy("angry-rome", 2*time.Hour)
+	middle.Processes = []*DeployProcess{{Name: "worker", Errors: []string{"exited"}}}
+	oldest := deploy("bored-oslo", 72*time.Hour)
+	oldest.Pinned = true
+	oldest.Target = "staging"
+
+	ids := func(deploys []*Deploy) []string {
+		ids := []string{}
+		for _, d := range deploys {
+			ids = append(ids, d.Id)
+		}
+		return ids
+	}
+	cases := []struct {
+		states   []string
+		target   TargetName
+		n        int
+		expected []string
+	}{
+		{nil, "", 0, []string{"happy-paris", "happy-paris", "angry-rome", "bored-oslo"}},
+		{nil, "", 2, []string{"happy-paris", "happy-paris", "angry-rome"}},
+		{[]string{"running"}, "", 0, []string{"happy-paris"}},
+		{[]string{"errored"}, "", 0, []string{"angry-rome"}},
+		{[]string{"running", "pinned"}, "", 0, []string{}},
+		{nil, "staging", 0, []string{"bored-oslo"}},
+		{[]string{"pinned"}, "prod", 0, []string{}},
+	}
+	for _, c := range cases {
+		deploys := []*Deploy{oldest, newestElsewhere, middle, newest}
+		got := ids(filterDeploys(deploys, c.states, c.target, c.n))
+		if len(got) != len(c.expected) {
+			t.Errorf("%v %q %d: expected %v, got %v", c.states, c.target, c.n, c.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.expected[i] {
+				t.Errorf("%v %q %d: expected %v, got %v", c.states, c.target, c.n, c.expected, got)
+				break
+			}
+		}
+	}
+}
+
+func TestListRelativeAge(t *testing.T) {
+	now := time.Date(2016, 5, 10, 12, 0, 0, 0, time.UTC)
+	ages := map[time.Duration]string{
+		10 * time.Second: "just now",
+		5 * time.Minute:  "5m ago",
+		3 * time.Hour:    "3h ago",
+		30 * time.Hour:   "30h ago",
+		80 * time.Hour:   "3d ago",
+	}
+	for age, expected := range ages {
+		if got := relativeAge(now.Add(-age), now); got != expected {
+			t.Errorf("%s: expected %q, got %q", age, expected, got)
+		}
+	}
+	if got := relativeAge(time.Time{}, now); got != "" {
+		t.Errorf("expected no age for an unknown time, got %q", got)
+	}
+}
+
+func TestHistoryParseTime(t *testing.T) {
+	now := time.Date(2016, 5, 10, 12, 0, 0, 0, time.UTC)
+	times := map[string]time.Time{
+		"":                     {},
+		"90m":                  now.Add(-90 * time.Minute),
+		"2016-05-01T10:00:00Z": time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC),
+		"2016-05-01 10:30":     time.Date(2016, 5, 1, 10, 30, 0, 0, time.UTC),
+		"2016-05-01":           time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for s, expected := range times {
+		got, err := parseHistoryTime(s, now)
+		if err != nil || !got.Equal(expected) {
+			t.Errorf("%q: expected %s, got %s, %v", s, expected, got, err)
+		}
+	}
+	if _, err := parseHistoryTime("yesterday", now); err == nil {
+		t.Errorf("expected an error for an unparseable time")
+	}
+}